@@ -0,0 +1,116 @@
+// alert.go defines the structured alert that every input format is decoded into, so that the rest of the pipeline
+// does not need to know which IDS sent it
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+)
+
+// Alert formats
+const (
+	fmtSyslog  = "syslog"  // Snort 2 alert_syslog
+	fmtFast    = "fast"    // Snort 2 alert_fast
+	fmtEVE     = "eve"     // Suricata EVE JSON
+	fmtSnort3  = "snort3"  // Snort 3 alert_json
+	fmtGeneric = "generic" // Any message containing an IPv4 address
+	fmtAuto    = "auto"    // Detect the format of each message
+)
+
+// An Alert is the information tnsrids uses from an IDS alert, whatever format it arrived in
+type Alert struct {
+	Format    string `json:"format"`
+	Attacker  string `json:"attacker"` // The address to block. Empty if none could be found
+	Src       string `json:"src,omitempty"`
+	Dst       string `json:"dst,omitempty"`
+	Direction string `json:"direction,omitempty"` // As reported by the IDS, e.g. "to_server"
+	GID       uint64 `json:"gid,omitempty"`
+	SID       uint64 `json:"sid,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Severity  int    `json:"severity,omitempty"` // 1 is the most severe
+	Sensor    string `json:"sensor,omitempty"`   // The IDS that sent the alert, or "local" for alerts read from files
+}
+
+// A Decoder extracts an alert from a message in one format
+type Decoder interface {
+	// Name of the format, as given in the config
+	Name() string
+	// Decode the message. ok is false if the message is not in this format
+	Decode(msg string) (a Alert, ok bool)
+}
+
+// A decoderFunc is a Decoder implemented by a parse function
+type decoderFunc struct {
+	name   string
+	decode func(string) (Alert, bool)
+}
+
+func (d decoderFunc) Name() string                    { return d.name }
+func (d decoderFunc) Decode(msg string) (Alert, bool) { return d.decode(msg) }
+
+// The decoders tried in turn when the format is detected automatically. The most specific formats come first, then
+// the user's patterns, and the generic decoder accepts anything with an address in it
+var autoDecoders = []Decoder{
+	decoderFunc{fmtEVE, parseEVE},
+	decoderFunc{fmtSnort3, parseSnort3JSON},
+	decoderFunc{fmtFast, parseSnortFast},
+	decoderFunc{fmtSyslog, parseSnortSyslog},
+	decoderFunc{fmtRegex, parsePatterns},
+	decoderFunc{fmtGeneric, parseGeneric},
+}
+
+// autoDecoder detects the format of each message
+type autoDecoder struct{}
+
+func (autoDecoder) Name() string { return fmtAuto }
+
+func (autoDecoder) Decode(msg string) (Alert, bool) {
+	for _, d := range autoDecoders {
+		if a, ok := d.Decode(msg); ok {
+			return a, true
+		}
+	}
+
+	return Alert{Format: fmtAuto}, false
+}
+
+// Return the decoder for the named format
+func newDecoder(name string) (Decoder, error) {
+	if len(name) == 0 || name == fmtAuto {
+		return autoDecoder{}, nil
+	}
+
+	for _, d := range autoDecoders {
+		if d.Name() == name {
+			return d, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Unknown alert format \"%s\"", name)
+}
+
+// Decode a message in an unknown format by taking the first IPv4 address in it to be the attacker
+func parseGeneric(msg string) (Alert, bool) {
+	addr := findIP(msg)
+	if len(addr) == 0 {
+		return Alert{}, false
+	}
+
+	return Alert{Format: fmtGeneric, Attacker: addr, Src: addr}, true
+}
@@ -0,0 +1,319 @@
+// api.go provides a local HTTP management API so that a running daemon can be queried and controlled without
+// starting a second tnsrids process. The API shares the daemon's rule cache and tnsrMutex
+//
+//	GET    /api/v1/rules               List the current rules (accepts the same filters as -show)
+//	POST   /api/v1/rules               Add a block rule. Body: {"prefix": "<cidr>", "duration": <minutes>, "reason": "..."}
+//	DELETE /api/v1/rules/<cidr|seq>    Remove a block rule. Optional ?reason=
+//	POST   /api/v1/reap                Reap expired rules now
+//	GET    /api/v1/stats               Daemon counters
+//	GET    /api/v1/alerts              Most recently received alerts
+//	GET    /metrics                    Prometheus metrics
+//	GET    /healthz, /readyz           Liveness and readiness
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const apiPrefix = "/api/v1/"
+const apiHeaderTimeout = 10 * time.Second // Time allowed for a client to send the request headers
+
+// Body of a POST to /api/v1/rules
+type blockRequest struct {
+	Prefix   string `json:"prefix"`
+	Duration uint64 `json:"duration"` // Minutes. 0 = use maxage
+	Reason   string `json:"reason"`
+}
+
+// Response to GET /api/v1/stats
+type apiStats struct {
+	Stats
+	Rules int `json:"rules"` // Number of rules in the caches of all targets
+}
+
+// Handlers for a path, keyed by HTTP method. Other methods are refused with the list of those allowed
+type methods map[string]http.HandlerFunc
+
+func (m methods) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h, ok := m[r.Method]; ok {
+		h(w, r)
+		return
+	}
+
+	var allowed []string
+	for method := range m {
+		allowed = append(allowed, method)
+	}
+
+	sort.Strings(allowed)
+
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+}
+
+// Return the handler for the management API
+func apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(apiPrefix+"rules", methods{http.MethodGet: apiListRules, http.MethodPost: apiAddRule})
+	mux.Handle(apiPrefix+"rules/", methods{http.MethodDelete: apiDeleteRule})
+	mux.Handle(apiPrefix+"reap", methods{http.MethodPost: apiReap})
+	mux.Handle(apiPrefix+"stats", methods{http.MethodGet: apiGetStats})
+	mux.Handle(apiPrefix+"alerts", methods{http.MethodGet: apiAlerts})
+	mux.Handle(apiPrefix+"suppressed", methods{http.MethodGet: apiSuppressed})
+	mux.Handle(apiPrefix+"panic", methods{http.MethodGet: apiGetPanic, http.MethodDelete: apiResume})
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+
+	return mux
+}
+
+// Returns true if addr (host:port) can only be reached from this machine
+func isLoopbackAddr(addr string) (bool, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false, err
+	}
+
+	if host == "localhost" {
+		return true, nil
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback(), nil
+}
+
+// Check that the API may listen on addr. The API has no authentication, so unless remote is set only loopback
+// addresses are permitted
+func checkAPIAddr(addr string, remote bool) error {
+	loopback, err := isLoopbackAddr(addr)
+	if err != nil {
+		return fmt.Errorf("Invalid api address \"%s\": %v", addr, err)
+	}
+
+	if loopback {
+		return nil
+	}
+
+	if !remote {
+		return fmt.Errorf("The management API has no authentication. Refusing to listen on %s, which is not a loopback address, unless apiremote is set", addr)
+	}
+
+	log.Printf("WARNING: The management API has no authentication and is listening on %s, which is not a loopback address", addr)
+	return nil
+}
+
+// Start the management API listening on addr. The returned server is shut down by the caller on exit
+func startAPI(addr string) *http.Server {
+	if verbose {
+		fmt.Printf("Starting management API on %s\n", addr)
+	}
+
+	log.Printf("INFO: Management API listening on %s", addr)
+
+	srv := &http.Server{Addr: addr, Handler: apiHandler(), ReadHeaderTimeout: apiHeaderTimeout}
+
+	go func() {
+		err := srv.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Printf("ERROR: Management API stopped: %v", err)
+		}
+	}()
+
+	return srv
+}
+
+// Write v as a JSON response with the specified status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Write an error response
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// Return the HTTP status for an error from blockHost() or unblockHost(). Anything other than an invalid request, a
+// missing or duplicate rule or a change refused by the standby is a failure to update TNSR
+func errorStatus(err error) int {
+	var ie *InputError
+
+	switch {
+	case errors.As(err, &ie):
+		return http.StatusBadRequest
+	case errors.Is(err, errNoRule):
+		return http.StatusNotFound
+	case err == errDuplicateRule:
+		return http.StatusConflict
+	case err == errStandby:
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusBadGateway
+}
+
+// Describe the API client for the audit log
+func apiClient(r *http.Request) string {
+	return "API client " + r.RemoteAddr
+}
+
+// GET lists the rules
+func apiListRules(w http.ResponseWriter, r *http.Request) {
+	options := make(map[string]string)
+	for k := range r.URL.Query() {
+		options[k] = r.URL.Query().Get(k)
+	}
+
+	// The same values are accepted as for the managed option
+	if val, ok := options["managed"]; ok {
+		managed, err := parseBool(val)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("managed: %v", err))
+			return
+		}
+
+		options["managed"] = managed
+	}
+
+	filter, err := newRuleFilter(options)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tnsrMutex.Lock()
+	err = getSnortBlockACL(r.Context(), false)
+	list := targetRuleInfo()
+	tnsrMutex.Unlock()
+
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	filter.timestamp = time.Now().Unix()
+	writeJSON(w, http.StatusOK, filter.applyByTarget(list))
+}
+
+// POST adds a block rule
+func apiAddRule(w http.ResponseWriter, r *http.Request) {
+	var req blockRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	duration := ""
+	if req.Duration > 0 {
+		duration = strconv.FormatUint(req.Duration, 10)
+	}
+
+	if len(req.Reason) == 0 {
+		req.Reason = "not specified"
+	}
+
+	err = blockHost(req.Prefix, duration, req.Reason, apiClient(r))
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, req)
+}
+
+// DELETE removes the rule for a prefix or sequence number
+func apiDeleteRule(w http.ResponseWriter, r *http.Request) {
+	target := strings.TrimPrefix(r.URL.Path, apiPrefix+"rules/")
+
+	reason := r.URL.Query().Get("reason")
+	if len(reason) == 0 {
+		reason = "not specified"
+	}
+
+	err := unblockHost(target, reason, apiClient(r))
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST triggers a reap of expired rules
+func apiReap(w http.ResponseWriter, r *http.Request) {
+	if !isLeader() {
+		writeError(w, http.StatusServiceUnavailable, errStandby)
+		return
+	}
+
+	err := reapACLs()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET returns the daemon counters
+func apiGetStats(w http.ResponseWriter, r *http.Request) {
+	rules := 0
+
+	for _, t := range currentTargets() {
+		rules += int(atomic.LoadInt64(&t.ruleCount))
+	}
+
+	writeJSON(w, http.StatusOK, apiStats{stats.snapshot(), rules})
+}
+
+// GET returns the most recent alerts
+func apiAlerts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, recentAlerts.list())
+}
+
+// GET returns the most recent blocks suppressed by the rate limits
+func apiSuppressed(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, limiter.list())
+}
+
+// GET returns whether automatic blocking has been stopped by the panic threshold
+func apiGetPanic(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]bool{"panic": limiter.inPanic()})
+}
+
+// DELETE resumes automatic blocking after a panic
+func apiResume(w http.ResponseWriter, r *http.Request) {
+	limiter.resume(apiClient(r))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,113 @@
+// auth.go builds the credentials used to authenticate with the TNSR RESTCONF server: HTTP basic auth (for TNSR
+// instances using PAM users) and the TLS configuration, which may use a client certificate or verify the server only
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Environment variables holding basic auth credentials. These are deliberately not options, so that a password
+// can never be given on the command line where other users could see it
+const envUser = "TNSRIDS_USERNAME"
+const envPassword = "TNSRIDS_PASSWORD"
+
+// Value of the ca option that verifies the server with the system CAs instead of a CA file
+const caSystem = "system"
+
+// Minimum TLS versions accepted by the tlsmin option
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Return the basic auth credentials from the environment if useEnv is set, or failing that from authfile, which
+// contains a single "username:password" line. Returns empty strings if neither is configured
+func loadCredentials(authfile string, useEnv bool) (string, string, error) {
+	if user, ok := os.LookupEnv(envUser); ok && useEnv {
+		return user, os.Getenv(envPassword), nil
+	}
+
+	if len(authfile) == 0 {
+		return "", "", nil
+	}
+
+	file, err := os.Open(authfile)
+	if err != nil {
+		return "", "", err
+	}
+
+	defer file.Close()
+
+	// The file holds a password, so it should not be readable by anyone else
+	info, err := file.Stat()
+	if err == nil && info.Mode().Perm()&0077 != 0 {
+		log.Printf("WARNING: Credentials file %s is accessible by other users", authfile)
+	}
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		return "", "", fmt.Errorf("Credentials file %s is empty", authfile)
+	}
+
+	s := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)
+	if len(s) != 2 || len(s[0]) == 0 {
+		return "", "", errors.New("Credentials file must contain username:password")
+	}
+
+	return s[0], s[1], nil
+}
+
+// Build the TLS configuration for an https:// host from the options
+// clientcert = no verifies the server using the CA but does not present a client certificate. ca = system verifies
+// the server using the system CAs. servername overrides the name sent in SNI and checked against the server certificate
+func buildTLSConfig(options map[string]string) (*tls.Config, error) {
+	certpath, keypath := options["certpath"], options["keypath"]
+	if options["clientcert"] == "no" {
+		certpath, keypath = "", ""
+	}
+
+	capath := options["capath"]
+	if capath == caSystem {
+		capath = ""
+	}
+
+	cfg, err := loadTLSConfig(capath, certpath, keypath)
+	if err != nil {
+		return nil, err
+	}
+
+	min, ok := tlsVersions[options["tlsmin"]]
+	if !ok {
+		return nil, fmt.Errorf("Invalid tlsmin \"%s\". Use 1.0, 1.1, 1.2 or 1.3", options["tlsmin"])
+	}
+
+	cfg.MinVersion = min
+	cfg.ServerName = options["servername"]
+
+	return cfg, nil
+}
@@ -0,0 +1,283 @@
+// certs.go watches the TLS ca, certificate and key files so that a rotated certificate is picked up without a
+// restart, and warns when the client certificate or CA is close to expiry
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the certificate files are checked for changes
+const certCheckPeriod string = "@every 1m"
+
+// How often a certificate problem is logged again if nothing has changed
+const certReportInterval = 24 * time.Hour
+
+// CertWatch remembers the TLS options of a target and the modification times of the files they name
+type CertWatch struct {
+	mutex    sync.Mutex
+	target   *Target
+	options  map[string]string    // Options used to build the current TLS configuration
+	mtimes   map[string]time.Time // Modification time of each file when last loaded
+	warnDays int                  // Warn when a certificate expires within this many days
+	inUse    map[string]time.Time // Expiry time of the client certificate and CA in the current TLS configuration
+	expiry   map[string]int64     // Epoch expiry time of the client certificate and CA, for metrics
+	state    map[string]string    // Problem last logged for each certificate. "" = none
+	reported map[string]time.Time // When the problem was last logged
+}
+
+// Record the options used to build the target's TLS configuration and the current state of the files.
+// Called whenever the target is built from the configuration
+func newCertWatch(t *Target, warnDays int) *CertWatch {
+	cw := &CertWatch{target: t, options: t.options, warnDays: warnDays, state: make(map[string]string), reported: make(map[string]time.Time)}
+
+	cw.mtimes = cw.fileTimes()
+	cw.loadExpiry()
+	cw.checkExpiry()
+	return cw
+}
+
+// Check the certificates of every target. Run periodically from cron
+func checkCerts() {
+	for _, t := range currentTargets() {
+		t.certWatch().check()
+	}
+}
+
+// The certificate files named in the options, keyed by what they are
+func (cw *CertWatch) files() map[string]string {
+	files := make(map[string]string)
+	if cw.options["capath"] != caSystem {
+		files["ca"] = cw.options["capath"]
+	}
+
+	if cw.options["clientcert"] != "no" {
+		files["client"] = cw.options["certpath"]
+		files["key"] = cw.options["keypath"]
+	}
+
+	return files
+}
+
+// Return the modification time of each certificate file
+func (cw *CertWatch) fileTimes() map[string]time.Time {
+	mtimes := make(map[string]time.Time)
+
+	for _, path := range cw.files() {
+		if len(path) == 0 {
+			continue
+		}
+
+		if info, err := os.Stat(path); err == nil {
+			mtimes[path] = info.ModTime()
+		}
+	}
+
+	return mtimes
+}
+
+// Reload the target's TLS configuration if any of the files have changed, and check for expiry
+func (cw *CertWatch) check() {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+
+	if !strings.HasPrefix(cw.options["host"], "https://") {
+		return
+	}
+
+	mtimes := cw.fileTimes()
+
+	changed := false
+	for path, t := range mtimes {
+		if !t.Equal(cw.mtimes[path]) {
+			changed = true
+		}
+	}
+
+	// The files may be part way through being replaced, so keep the old configuration if they don't load. They are
+	// not tried again until one of them changes, so the error is only logged once for each change
+	if changed {
+		cw.mtimes = mtimes
+
+		cfg, err := buildTLSConfig(cw.options)
+		if err != nil {
+			log.Printf("ERROR: Certificate files for %s changed but could not be loaded. Keeping the current certificates: %v", cw.target.Name, err)
+		} else {
+			cw.target.setTLS(cfg)
+			cw.loadExpiry()
+			log.Printf("INFO: Reloaded TLS certificates for %s", cw.target.Name)
+		}
+	}
+
+	cw.checkExpiry()
+}
+
+// Read the expiry times of the client certificate and CA from which the TLS configuration was just built
+func (cw *CertWatch) loadExpiry() {
+	cw.inUse = make(map[string]time.Time)
+
+	if !strings.HasPrefix(cw.options["host"], "https://") {
+		return
+	}
+
+	for name, path := range cw.files() {
+		if name == "key" || len(path) == 0 {
+			continue
+		}
+
+		notAfter, err := certExpiry(path)
+		if err != nil {
+			cw.report(name, "unreadable", fmt.Sprintf("ERROR: Unable to read the expiry time of %s: %v", path, err))
+			continue
+		}
+
+		cw.inUse[name] = notAfter
+	}
+}
+
+// Log a warning for each certificate in use that is within warnDays of expiry and record the expiry times for the
+// metrics. A problem is logged when it first appears and then once a day, not every time the files are checked
+func (cw *CertWatch) checkExpiry() {
+	cw.expiry = make(map[string]int64)
+	files := cw.files()
+
+	for name, notAfter := range cw.inUse {
+		path := files[name]
+		cw.expiry[name] = notAfter.Unix()
+
+		days := int(time.Until(notAfter).Hours() / 24)
+		switch {
+		case days < 0:
+			cw.report(name, "expired", fmt.Sprintf("WARNING: The %s certificate %s expired on %s", name, path, notAfter.Format(time.RFC3339)))
+		case days < cw.warnDays:
+			cw.report(name, "expiring", fmt.Sprintf("WARNING: The %s certificate %s expires in %d days (%s)", name, path, days, notAfter.Format(time.RFC3339)))
+		default:
+			cw.report(name, "", "")
+		}
+	}
+}
+
+// Log msg if the state of the named certificate has changed, or if it was last logged more than a day ago
+// An empty state means there is no problem and nothing is logged
+func (cw *CertWatch) report(name string, state string, msg string) {
+	now := time.Now()
+	if state == cw.state[name] && (len(state) == 0 || now.Sub(cw.reported[name]) < certReportInterval) {
+		return
+	}
+
+	cw.state[name] = state
+	cw.reported[name] = now
+
+	if len(state) > 0 {
+		log.Print(msg)
+	}
+}
+
+// Return the earliest expiry time of the certificates in a PEM file
+func certExpiry(path string) (time.Time, error) {
+	var earliest time.Time
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return earliest, err
+	}
+
+	for {
+		var block *pem.Block
+
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return earliest, err
+		}
+
+		if earliest.IsZero() || cert.NotAfter.Before(earliest) {
+			earliest = cert.NotAfter
+		}
+	}
+
+	if earliest.IsZero() {
+		return earliest, errors.New("No certificates found")
+	}
+
+	return earliest, nil
+}
+
+// Return the expiry times of the client certificate and CA, for the metrics
+func (cw *CertWatch) expiryTimes() map[string]int64 {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+
+	times := make(map[string]int64)
+	for k, v := range cw.expiry {
+		times[k] = v
+	}
+
+	return times
+}
+
+// Write the certificate expiry metrics for every target
+func writeCertMetrics(w io.Writer) {
+	var watches []*CertWatch
+
+	for _, t := range currentTargets() {
+		watches = append(watches, t.certWatch())
+	}
+
+	now := time.Now().Unix()
+
+	fmt.Fprintf(w, "# HELP tnsrids_tls_cert_expiry_timestamp_seconds Expiry time of the TLS client certificate and CA\n# TYPE tnsrids_tls_cert_expiry_timestamp_seconds gauge\n")
+	for _, cw := range watches {
+		times := cw.expiryTimes()
+		for _, name := range []string{"client", "ca"} {
+			if t, ok := times[name]; ok {
+				fmt.Fprintf(w, "tnsrids_tls_cert_expiry_timestamp_seconds{target=\"%s\",cert=\"%s\"} %d\n", labelValue(cw.target.Name), name, t)
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP tnsrids_tls_cert_expiring 1 if the certificate expires within the warning period\n# TYPE tnsrids_tls_cert_expiring gauge\n")
+	for _, cw := range watches {
+		times := cw.expiryTimes()
+		warn := int64(cw.warnDays) * 86400
+		for _, name := range []string{"client", "ca"} {
+			if t, ok := times[name]; ok {
+				fmt.Fprintf(w, "tnsrids_tls_cert_expiring{target=\"%s\",cert=\"%s\"} %d\n", labelValue(cw.target.Name), name, boolMetric(t-now < warn))
+			}
+		}
+	}
+}
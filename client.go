@@ -0,0 +1,229 @@
+// client.go holds the per-target HTTP clients used for RESTCONF calls, along with the retry policy and a circuit breaker
+// that stops tnsrids hammering TNSR while it is unreachable
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Retry and circuit breaker defaults
+const restBackoff = 500 * time.Millisecond // Delay before the first retry. Doubled on each subsequent retry
+const maxBackoff = 30 * time.Second        // Upper limit of the retry delay
+const breakerThreshold = 5                 // Consecutive failures after which the breaker opens
+const breakerCooldown = 30 * time.Second   // How long the breaker stays open before a trial call is allowed
+
+// Number of times a failed RESTCONF call is retried, and the timeout for each attempt. Set from the config
+var restRetries = 3
+var restTimeout = 10 * time.Second
+
+// Returned by rest() without contacting TNSR while the circuit breaker is open
+var errCircuitOpen = errors.New("TNSR is unreachable (circuit breaker open)")
+
+// A RESTError is a failed RESTCONF call. Status is the HTTP status, or 0 if no response was received
+type RESTError struct {
+	Status int
+	Err    error
+}
+
+func (e *RESTError) Error() string {
+	return e.Err.Error()
+}
+
+// Returns true if the error is one that may succeed if tried again later: no response, a server error or an open breaker
+func retryable(err error) bool {
+	if err == errCircuitOpen {
+		return true
+	}
+
+	var re *RESTError
+	if errors.As(err, &re) {
+		return re.Status == 0 || re.Status >= 500
+	}
+
+	return false
+}
+
+// Double the delay, up to maxBackoff
+func nextBackoff(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+
+	return delay
+}
+
+// Return the target's HTTP client, creating it on first use so that it picks up the TLS configuration.
+// Sharing the client allows connections to TNSR to be reused
+func (t *Target) restClient() *http.Client {
+	t.clientMutex.Lock()
+	defer t.clientMutex.Unlock()
+
+	if t.client == nil {
+		transport := &http.Transport{
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+			TLSClientConfig:     t.tlsConfig,
+		}
+
+		t.client = &http.Client{Transport: transport, Timeout: restTimeout}
+	}
+
+	return t.client
+}
+
+// Add the target's basic auth credentials, if any, to a request
+func (t *Target) setAuth(req *http.Request) {
+	t.clientMutex.Lock()
+	defer t.clientMutex.Unlock()
+
+	if len(t.user) > 0 {
+		req.SetBasicAuth(t.user, t.password)
+	}
+}
+
+// Replace the TLS configuration and discard the client so that the next call uses it
+func (t *Target) setTLS(cfg *tls.Config) {
+	t.clientMutex.Lock()
+	defer t.clientMutex.Unlock()
+
+	t.tlsConfig = cfg
+	t.resetClientLocked()
+}
+
+// Discard the client so that the next call creates one with the current TLS configuration and timeout
+func (t *Target) resetClient() {
+	t.clientMutex.Lock()
+	defer t.clientMutex.Unlock()
+
+	t.resetClientLocked()
+}
+
+// Discard the client. Must be called with clientMutex held
+func (t *Target) resetClientLocked() {
+	if t.client != nil {
+		t.client.CloseIdleConnections()
+	}
+
+	t.client = nil
+}
+
+// A CircuitBreaker counts consecutive RESTCONF failures. Once the threshold is reached it opens, and calls fail
+// immediately until the cooldown has passed, at which point a single trial call is allowed through. If the trial
+// fails, the breaker stays open for another cooldown
+type CircuitBreaker struct {
+	name      string // Target name, for the log messages
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+	open      bool
+	trial     bool // A trial call is in progress
+}
+
+// Returns true if a call may be made. Once the cooldown has passed the first caller is given the trial call, which
+// must be followed by record() or release(), and the others are refused until its result is known
+func (b *CircuitBreaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.open {
+		return true
+	}
+
+	if b.trial || time.Now().Before(b.openUntil) {
+		return false
+	}
+
+	b.trial = true
+	return true
+}
+
+// Returns true if allow() would let a call through, without taking the trial call
+func (b *CircuitBreaker) ready() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return !b.open || (!b.trial && !time.Now().Before(b.openUntil))
+}
+
+// Give up a call allowed by allow() without a result, so that another trial call may be made
+func (b *CircuitBreaker) release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.trial = false
+}
+
+// Record the result of a call
+func (b *CircuitBreaker) record(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.trial = false
+
+	if err == nil || !retryable(err) {
+		if b.open {
+			log.Printf("INFO: TNSR %s is reachable again. Resuming", b.name)
+		}
+
+		b.failures = 0
+		b.open = false
+		return
+	}
+
+	b.failures++
+	if b.failures >= breakerThreshold {
+		if !b.open {
+			log.Printf("ERROR: TNSR %s unreachable after %d attempts. Pausing for %v", b.name, b.failures, breakerCooldown)
+		}
+
+		b.open = true
+		b.openUntil = time.Now().Add(breakerCooldown)
+	}
+}
+
+// Returns true if the breaker is open
+func (b *CircuitBreaker) isOpen() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.open
+}
+
+// Return how long until a trial call is allowed. 0 if the breaker is closed or the cooldown has passed
+func (b *CircuitBreaker) remaining() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.open {
+		return 0
+	}
+
+	if d := time.Until(b.openUntil); d > 0 {
+		return d
+	}
+
+	return 0
+}
@@ -25,8 +25,16 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 // Configuration defaults
@@ -34,27 +42,106 @@ const dfltConf string = "/etc/tnsrids/tnsrids.conf"
 const dfltHost string = "https://localhost"      // Address of TNSR instance
 const dfltMaxage string = "60"                   // Maximum age of rules before they are reap()-ed
 const dfltPort string = "12345"                  // Default UDP port on whic alert messages are received
+const dfltTimeout string = "10"                  // Timeout for each RESTCONF call in seconds
+const dfltRetries string = "3"                   // Number of retries for failed RESTCONF calls
+const dfltSpoolMax string = "100000"             // Maximum number of pending blocks in the spool
+const dfltDrain string = "30"                    // Seconds allowed for draining the queue on shutdown
+const dfltTLSMin string = "1.2"                  // Minimum TLS version
+const dfltCertWarn string = "30"                 // Days before certificate expiry at which to start warning
 const dfltCA string = "/etc/tnsrids/.tls/ca.crt" // Default location of TLS ertificates
 const dfltCert string = "/etc/tnsrids/.tls/tnsr.crt"
 const dfltKey string = "/etc/tnsrids/.tls/tnsr.key"
 
+// The kinds of value an option may take. The kind determines how the value is validated
+type OptKind int
+
+const (
+	optString   OptKind = iota // Any string
+	optBool                    // yes/no, true/false, on/off, 1/0. Normalized to "yes" or "no"
+	optInt                     // Non-negative integer
+	optDuration                // Integer number of the item's unit, or a Go duration such as "90s" or "2h"
+	optPath                    // Path to a file which must exist
+	optURL                     // http:// or https:// URL
+	optCIDRList                // Comma separated list of addresses or prefixes
+	optCAPath                  // Path to a CA file which must exist, or "system" for the system CAs
+)
+
 // A Config is a list of configuration items that specify the option details
 type Config struct {
 	//	filename string
-	items []ConfigItem
+	items    []ConfigItem
+	args     map[string]string // Command line arguments, parsed on the first call to read()
+	set      map[string]bool   // Options explicitly set on the command line
+	env      map[string]string // Options set by TNSRIDS_* environment variables
+	sections map[string]bool   // Names of structured sections permitted in YAML config files
+	file     ConfigFile        // The config file read by the most recent read()
+	problems []ConfigProblem   // Problems found by the most recent read()
 }
 
 type ConfigItem struct {
-	name   string // The name of this config item (used  as a map key)
-	arg    string // Command line argument that sets it
-	hasval bool   // Does this command line flag have an associated value string
-	descr  string // Description of the item used in constructing usage/help
-	dflt   string // Default value for this item
+	name   string        // The name of this config item (used  as a map key)
+	arg    string        // Command line argument that sets it
+	hasval bool          // Does this command line flag have an associated value string
+	descr  string        // Description of the item used in constructing usage/help
+	dflt   string        // Default value for this item
+	kind   OptKind       // Type of value expected
+	unit   time.Duration // Unit of a plain integer optDuration value
+}
+
+// A ConfigProblem is an invalid, unknown or malformed option, and where it came from
+type ConfigProblem struct {
+	file    string // Config file path, or "" if the value came from the command line or default
+	line    int
+	source  string // "command line", "environment" or "default" when file is ""
+	msg     string
+	warning bool // Warnings (e.g. unknown keys) do not prevent tnsrids from running
+}
+
+func (p ConfigProblem) String() string {
+	level := "ERROR"
+	if p.warning {
+		level = "WARNING"
+	}
+
+	if len(p.file) > 0 {
+		return fmt.Sprintf("%s:%d: %s: %s", p.file, p.line, level, p.msg)
+	}
+
+	return fmt.Sprintf("%s: %s: %s", p.source, level, p.msg)
+}
+
+// The contents of a config file, with the line on which each key was found
+type ConfigFile struct {
+	path     string
+	values   map[string]string
+	lines    map[string]int
+	sections map[string]*yaml.Node // Structured sections (YAML only), decoded by the features that use them
+	problems []ConfigProblem
 }
 
 // Add a new config item specification to the configuration parser
 func (cfg *Config) addOption(name string, arg string, hasval bool, descr string, dflt string) {
-	cfg.items = append(cfg.items, ConfigItem{name, arg, hasval, descr, dflt})
+	kind := optString
+	if !hasval {
+		kind = optBool
+	}
+
+	cfg.items = append(cfg.items, ConfigItem{name, arg, hasval, descr, dflt, kind, 0})
+}
+
+// Add a new config item specification with a specific kind of value. unit is only used by optDuration
+func (cfg *Config) addTypedOption(name string, arg string, kind OptKind, unit time.Duration, descr string, dflt string) {
+	cfg.items = append(cfg.items, ConfigItem{name, arg, kind != optBool, descr, dflt, kind, unit})
+}
+
+// Permit a structured section (e.g. a list of targets) in YAML config files. The section is not flattened into
+// options but kept for the feature that uses it
+func (cfg *Config) addSection(name string) {
+	if cfg.sections == nil {
+		cfg.sections = make(map[string]bool)
+	}
+
+	cfg.sections[name] = true
 }
 
 // Print a table of options and help strings
@@ -78,17 +165,24 @@ func (cfg Config) printUsage(title string) {
 }
 
 // Read the command line arguments
+// Read the TNSRIDS_* environment variables
 // Read the config file values
-// Combine the two plus the defaults
+// Combine them plus the defaults, in that order of precedence
+// read() may be called again (e.g. on SIGHUP) to re-read the config file. The command line is only parsed once
+// Any problems found are logged and available from errors() and warnings()
 func (cfg *Config) read() map[string]string {
 	cfgpath := ""
 
-	// These two options are added by default so the program knows where to find the config file
-	// and can provide help
-	cfg.addOption("help", "help", false, "Output usage information to the console", "no")
-	cfg.addOption("cfgpath", "c", true, "Path to configuration file", dfltConf)
+	if cfg.args == nil {
+		// These two options are added by default so the program knows where to find the config file
+		// and can provide help
+		cfg.addOption("help", "help", false, "Output usage information to the console", "no")
+		cfg.addOption("cfgpath", "c", true, "Path to configuration file", dfltConf)
+
+		cfg.args, cfg.set = cfg.readArgs()
+	}
 
-	argmap := cfg.readArgs()
+	argmap := cfg.args
 
 	if len(argmap["cfgpath"]) > 0 {
 		cfgpath = argmap["cfgpath"]
@@ -96,22 +190,220 @@ func (cfg *Config) read() map[string]string {
 		cfgpath = dfltConf
 	}
 
-	confmap, err := readConfigFile(cfgpath)
+	cf, err := readConfigFile(cfgpath, cfg.sections)
 	if err != nil {
 		log.Printf("%v", err)
 	}
 
-	return cfg.mergeItems(argmap, confmap)
+	cfg.env = cfg.readEnv()
+	confmap := cfg.resolveKeys(&cf)
+	merged := cfg.mergeItems(argmap, cfg.env, confmap)
+	cfg.file = cf
+
+	cfg.problems = append(cf.problems, cfg.validate(merged, cf)...)
+	sort.SliceStable(cfg.problems, func(i, j int) bool {
+		return len(cfg.problems[i].file) > 0 && (len(cfg.problems[j].file) == 0 || cfg.problems[i].line < cfg.problems[j].line)
+	})
+
+	for _, p := range cfg.problems {
+		log.Printf("%v", p)
+	}
+
+	return merged
+}
+
+// Return the problems which prevent the configuration being used
+func (cfg Config) errors() []ConfigProblem {
+	var errs []ConfigProblem
+
+	for _, p := range cfg.problems {
+		if !p.warning {
+			errs = append(errs, p)
+		}
+	}
+
+	return errs
+}
+
+// Map the keys in a config file to option names. Keys may be either the option name or its command line argument
+// (e.g. "capath" or "ca"). Unknown keys are reported as warnings
+func (cfg Config) resolveKeys(cf *ConfigFile) map[string]string {
+	confmap := make(map[string]string)
+	lines := make(map[string]int)
+
+	for key, val := range cf.values {
+		name := ""
+		for _, ci := range cfg.items {
+			if key == ci.name || key == ci.arg {
+				name = ci.name
+				break
+			}
+		}
+
+		if len(name) == 0 {
+			cf.problems = append(cf.problems, ConfigProblem{file: cf.path, line: cf.lines[key], msg: fmt.Sprintf("Unknown option \"%s\" ignored", key), warning: true})
+			continue
+		}
+
+		// If an option is set more than once (e.g. as "ca" and "capath"), the last one wins
+		if lines[name] > cf.lines[key] {
+			continue
+		}
+
+		confmap[name] = val
+		lines[name] = cf.lines[key]
+	}
+
+	cf.lines = lines
+	return confmap
+}
+
+// Check every merged value against its kind. Booleans are normalized to "yes" or "no" in place
+func (cfg Config) validate(merged map[string]string, cf ConfigFile) []ConfigProblem {
+	var problems []ConfigProblem
+
+	for _, ci := range cfg.items {
+		val := merged[ci.name]
+		if len(val) == 0 {
+			continue
+		}
+
+		p := ConfigProblem{}
+		if cfg.set[ci.name] {
+			p.source = "command line"
+		} else if len(cfg.env[ci.name]) > 0 {
+			p.source = "environment"
+		} else if line, ok := cf.lines[ci.name]; ok {
+			p.file = cf.path
+			p.line = line
+		} else {
+			p.source = "default"
+		}
+
+		// Default file paths are only needed in some configurations (e.g. TLS), so they are checked when used
+		if p.source == "default" && (ci.kind == optPath || ci.kind == optCAPath) {
+			continue
+		}
+
+		err := ci.check(val)
+		if err != nil {
+			p.msg = fmt.Sprintf("%s: %v", ci.name, err)
+			problems = append(problems, p)
+			continue
+		}
+
+		if ci.kind == optBool {
+			merged[ci.name], _ = parseBool(val)
+		}
+	}
+
+	return problems
+}
+
+// Check that a value is valid for the item's kind
+func (ci ConfigItem) check(val string) error {
+	switch ci.kind {
+	case optBool:
+		_, err := parseBool(val)
+		return err
+
+	case optInt:
+		_, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return fmt.Errorf("\"%s\" is not a non-negative integer", val)
+		}
+
+	case optDuration:
+		_, err := parseDuration(val, ci.unit)
+		return err
+
+	case optPath, optCAPath:
+		if ci.kind == optCAPath && val == caSystem {
+			return nil
+		}
+
+		_, err := os.Stat(val)
+		if err != nil {
+			return fmt.Errorf("\"%s\" is not accessible: %v", val, err)
+		}
+
+	case optURL:
+		u, err := url.Parse(val)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("\"%s\" is not an http:// or https:// URL", val)
+		}
+
+	case optCIDRList:
+		_, err := parseCIDRList(val)
+		return err
+	}
+
+	return nil
+}
+
+// Convert a boolean option value to "yes" or "no"
+func parseBool(val string) (string, error) {
+	switch strings.ToLower(val) {
+	case "yes", "true", "on", "1":
+		return "yes", nil
+	case "no", "false", "off", "0":
+		return "no", nil
+	}
+
+	return "", fmt.Errorf("\"%s\" is not a boolean (yes/no)", val)
+}
+
+// Parse a duration which is either a plain non-negative integer number of units, or a Go duration string
+func parseDuration(val string, unit time.Duration) (time.Duration, error) {
+	n, err := strconv.ParseUint(val, 10, 64)
+	if err == nil {
+		return time.Duration(n) * unit, nil
+	}
+
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("\"%s\" is not a duration (e.g. 30 or 90s, 15m, 2h)", val)
+	}
+
+	return d, nil
+}
+
+// Parse a comma separated list of addresses or prefixes
+func parseCIDRList(val string) ([]*net.IPNet, error) {
+	var list []*net.IPNet
+
+	for _, s := range strings.Split(val, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+
+		prefix, err := normalizePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+
+		_, ipnet, _ := net.ParseCIDR(prefix)
+		list = append(list, ipnet)
+	}
+
+	return list, nil
 }
 
 // Read the command line arguments by creating a flag entry for each option, then parsing the flags
-func (cfg Config) readArgs() map[string]string {
+// Also returns the set of options that were explicitly given, so that an unset boolean flag does not override
+// the config file
+func (cfg Config) readArgs() (map[string]string, map[string]bool) {
 	args := make(map[string]*string)
 	boolargs := make(map[string]*bool)
 	combo := make(map[string]string)
+	set := make(map[string]bool)
+	names := make(map[string]string)
 
 	// Options expecting sting arguments, and boolean options (which do not) are added differently
 	for idx := 0; idx < len(cfg.items); idx++ {
+		names[cfg.items[idx].arg] = cfg.items[idx].name
+
 		if cfg.items[idx].hasval {
 			args[cfg.items[idx].name] = flag.String(cfg.items[idx].arg, "", cfg.items[idx].descr)
 		} else {
@@ -121,9 +413,13 @@ func (cfg Config) readArgs() map[string]string {
 
 	flag.Parse()
 
+	flag.Visit(func(f *flag.Flag) { set[names[f.Name]] = true })
+
 	// Now that there is a map of pointers to command line options, translate that to a map of strings
 	for k, v := range boolargs {
-		if *v {
+		if !set[k] {
+			combo[k] = ""
+		} else if *v {
 			combo[k] = "yes"
 		} else {
 			combo[k] = "no"
@@ -134,33 +430,55 @@ func (cfg Config) readArgs() map[string]string {
 		combo[k] = *v
 	}
 
-	return combo
+	return combo, set
 }
 
-// If a command line argument is provided, use it, otherwise use the config file value or the default
-func merge(arg string, conf string, dflt string) string {
-	if len(arg) == 0 {
-		if len(conf) != 0 {
-			return conf
-		} else {
-			return dflt
+// Return the first non-empty value, or the default if they are all empty
+func merge(dflt string, vals ...string) string {
+	for _, v := range vals {
+		if len(v) != 0 {
+			return v
 		}
 	}
 
-	return arg
+	return dflt
 }
 
-// Iterate over the list of options, merging the command line, config file and defaults
-func (cfg Config) mergeItems(args map[string]string, conf map[string]string) map[string]string {
+// Iterate over the list of options, merging the layers (usually command line, environment and config file, in
+// order of precedence) and defaults
+func (cfg Config) mergeItems(layers ...map[string]string) map[string]string {
 	mergedmap := make(map[string]string)
+	vals := make([]string, len(layers))
 
 	for _, ci := range cfg.items {
-		mergedmap[ci.name] = merge(args[ci.name], conf[ci.name], ci.dflt)
+		for idx, layer := range layers {
+			vals[idx] = layer[ci.name]
+		}
+
+		mergedmap[ci.name] = merge(ci.dflt, vals...)
 	}
 
 	return mergedmap
 }
 
+// Name of the environment variable that sets an option e.g. TNSRIDS_MAXAGE
+func envName(name string) string {
+	return "TNSRIDS_" + strings.ToUpper(name)
+}
+
+// Read the options that are set in the environment
+func (cfg Config) readEnv() map[string]string {
+	env := make(map[string]string)
+
+	for _, ci := range cfg.items {
+		if val, ok := os.LookupEnv(envName(ci.name)); ok {
+			env[ci.name] = val
+		}
+	}
+
+	return env
+}
+
 // Debug func to print the current options
 func (cfg Config) printOpts() {
 	args := cfg.read()
@@ -170,39 +488,52 @@ func (cfg Config) printOpts() {
 	}
 }
 
-// Read a config file and return its contents in a map
+// Read a config file and return its contents, with the line number of each key and any malformed lines
+// Files ending in .yaml or .yml are read as YAML, anything else as the flat key = value format
 // There are many Go config file packages available, but most are more complicated than needed here
-func readConfigFile(filename string) (map[string]string, error) {
-	cfg := make(map[string]string)
+func readConfigFile(filename string, sections map[string]bool) (ConfigFile, error) {
+	cf := ConfigFile{path: filename, values: make(map[string]string), lines: make(map[string]int)}
+
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == ".yaml" || ext == ".yml" {
+		return readYAMLConfig(cf, sections)
+	}
 
 	file, err := os.Open(filename)
 	if err != nil {
-		return cfg, errors.New("Unable to open configuration file. Using default values")
+		return cf, errors.New("Unable to open configuration file. Using default values")
 	}
 
 	defer file.Close()
 
 	scanner := bufio.NewScanner(file)
+	line := 0
 
 	for scanner.Scan() {
-		// Ignore comment lines
-		if strings.HasPrefix(scanner.Text(), "#") {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+
+		// Ignore comment and blank lines
+		if strings.HasPrefix(text, "#") || len(text) == 0 {
 			continue
 		}
 
-		s := strings.SplitN(scanner.Text(), "=", 2)
-		// Ignore mal-formed lines
-		if len(s) != 2 {
+		s := strings.SplitN(text, "=", 2)
+		// Report mal-formed lines
+		if len(s) != 2 || len(strings.TrimSpace(s[0])) == 0 {
+			cf.problems = append(cf.problems, ConfigProblem{file: filename, line: line, msg: fmt.Sprintf("Malformed line \"%s\" ignored. Expected key = value", text), warning: true})
 			continue
 		}
 
 		// Trim white space from front and back, delete any quotes and make the key lower case
-		cfg[strings.ToLower(strings.TrimSpace(s[0]))] = strings.Replace(strings.TrimSpace(s[1]), "\"", "", -1)
+		key := strings.ToLower(strings.TrimSpace(s[0]))
+		cf.values[key] = strings.Replace(strings.TrimSpace(s[1]), "\"", "", -1)
+		cf.lines[key] = line
 	}
 
 	if err := scanner.Err(); err != nil {
 		log.Fatal(err)
 	}
 
-	return cfg, nil
+	return cf, nil
 }
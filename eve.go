@@ -0,0 +1,83 @@
+// eve.go decodes Suricata EVE JSON alert events, either bare or wrapped in a syslog header as written by
+// Suricata's syslog output
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// The parts of an EVE event that tnsrids uses
+type eveEvent struct {
+	EventType string    `json:"event_type"`
+	SrcIP     string    `json:"src_ip"`
+	DestIP    string    `json:"dest_ip"`
+	Direction string    `json:"direction"`
+	Alert     *eveAlert `json:"alert"`
+}
+
+type eveAlert struct {
+	GID         uint64 `json:"gid"`
+	SignatureID uint64 `json:"signature_id"`
+	Signature   string `json:"signature"`
+	Severity    int    `json:"severity"`
+	Source      *struct {
+		IP string `json:"ip"`
+	} `json:"source"` // Set when the rule identifies the attacker with the "target" keyword
+}
+
+// Decode an EVE event. ok is false if the message is not EVE JSON. Events other than alerts are decoded with no
+// attacker, so they are counted as rejected
+func parseEVE(msg string) (Alert, bool) {
+	var ev eveEvent
+
+	start := strings.IndexByte(msg, '{')
+	if start < 0 {
+		return Alert{}, false
+	}
+
+	err := json.Unmarshal([]byte(msg[start:]), &ev)
+	if err != nil || len(ev.EventType) == 0 {
+		return Alert{}, false
+	}
+
+	a := Alert{Format: fmtEVE, Src: ev.SrcIP, Dst: ev.DestIP, Direction: ev.Direction}
+	if ev.EventType != "alert" || ev.Alert == nil {
+		return a, true
+	}
+
+	a.GID = ev.Alert.GID
+	a.SID = ev.Alert.SignatureID
+	a.Signature = ev.Alert.Signature
+	a.Severity = ev.Alert.Severity
+
+	// Suricata knows which end is the attacker if the rule says so. Otherwise block the client, which is the
+	// destination of a packet flowing to_client
+	switch {
+	case ev.Alert.Source != nil && len(ev.Alert.Source.IP) > 0:
+		a.Attacker = ev.Alert.Source.IP
+	case ev.Direction == "to_client":
+		a.Attacker = ev.DestIP
+	default:
+		a.Attacker = ev.SrcIP
+	}
+
+	return a, true
+}
@@ -0,0 +1,300 @@
+// follow.go reads alerts from files written by the IDS (e.g. Snort alert_fast or Suricata eve.json) as they grow,
+// in the manner of "tail -F". Files are followed across rotation and truncation, and the offsets can be saved so that
+// a restart resumes where the previous run left off
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const followPoll = time.Second   // How often the files are checked for new alerts
+const fingerprintLen = 256       // Number of bytes at the start of a file used to recognise it after a restart
+const maxLineLen = 64 * 1024     // Longer lines are discarded
+const followReadSize = 32 * 1024 // Size of each read
+const followStateMode = 0600     // Permissions of the offset file
+
+// A FollowState is the saved position in a file. The file is recognised by a hash of its first bytes, since the
+// same path names a different file after rotation
+type FollowState struct {
+	Offset int64  `json:"offset"`
+	FPLen  int    `json:"fplen"` // Number of bytes hashed
+	FP     string `json:"fp"`
+}
+
+// A Follower reads the alerts from one file
+type Follower struct {
+	path    string
+	file    *os.File
+	offset  int64  // Position of the next read
+	partial []byte // An incomplete line at the end of the file
+	discard bool   // The rest of an over-long line is skipped
+	fpLen   int
+	fp      string
+	opened  bool // The file has been opened before, so a new file at the path is read from the start
+	dec     Decoder
+}
+
+// Return the fingerprint of the file: the hash of its first n bytes
+func fingerprint(file *os.File, n int) (string, int) {
+	buf := make([]byte, n)
+
+	read, err := file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", 0
+	}
+
+	sum := sha256.Sum256(buf[:read])
+	return hex.EncodeToString(sum[:]), read
+}
+
+// Open the file. At start-up, reading resumes from the saved offset if the file is the one it was saved for, and
+// otherwise starts at the end of the file so that old alerts are not acted on again. After rotation the new file is
+// read from the start. Returns false if the file can not be opened yet
+func (f *Follower) open(saved *FollowState) bool {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return false
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return false
+	}
+
+	f.file = file
+	f.partial = nil
+	f.discard = false
+	f.offset = 0
+
+	if !f.opened {
+		f.offset = info.Size()
+
+		if saved != nil {
+			fp, n := fingerprint(file, saved.FPLen)
+			if n == saved.FPLen && fp == saved.FP && saved.Offset <= info.Size() {
+				f.offset = saved.Offset
+			}
+		}
+
+		log.Printf("INFO: Following %s from offset %d", f.path, f.offset)
+	}
+
+	f.fp, f.fpLen = fingerprint(file, fingerprintLen)
+	f.opened = true
+	return true
+}
+
+// Read any new lines from the file and pass them to parseAlerts(). Returns true if the position changed
+func (f *Follower) read(hf chan<- string) bool {
+	buf := make([]byte, followReadSize)
+	start := f.offset
+
+	for {
+		n, err := f.file.ReadAt(buf, f.offset)
+		if n > 0 {
+			f.offset += int64(n)
+			data := append(f.partial, buf[:n]...)
+
+			// The end of a discarded line is not an alert of its own
+			if f.discard {
+				idx := bytes.IndexByte(data, '\n')
+				if idx < 0 {
+					data = nil
+				} else {
+					data = data[idx+1:]
+					f.discard = false
+				}
+			}
+
+			for {
+				idx := bytes.IndexByte(data, '\n')
+				if idx < 0 {
+					break
+				}
+
+				line := strings.TrimRight(string(data[:idx]), "\r")
+				data = data[idx+1:]
+
+				if len(line) > 0 {
+					parseAlerts(line, localSensor, f.dec, hf)
+				}
+			}
+
+			f.partial = append([]byte(nil), data...)
+			if len(f.partial) > maxLineLen {
+				log.Printf("ERROR: Discarding a line of more than %d bytes in %s", maxLineLen, f.path)
+				f.partial = nil
+				f.discard = true
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	// The fingerprint can not be complete until the file is long enough
+	if f.fpLen < fingerprintLen && f.offset > int64(f.fpLen) {
+		f.fp, f.fpLen = fingerprint(f.file, fingerprintLen)
+	}
+
+	return f.offset != start
+}
+
+// Check the file for new lines, truncation and rotation. Returns true if the position changed
+func (f *Follower) poll(saved *FollowState, hf chan<- string) bool {
+	if f.file == nil && !f.open(saved) {
+		// A file that appears later is new, so it is read from the start
+		f.opened = true
+		return false
+	}
+
+	cur, err := f.file.Stat()
+	if err != nil {
+		return false
+	}
+
+	// Truncated, or truncated and rewritten since the last poll so that the start of the file has changed
+	if fp, n := fingerprint(f.file, f.fpLen); cur.Size() < f.offset || n < f.fpLen || fp != f.fp {
+		log.Printf("INFO: %s was truncated. Reading from the start", f.path)
+		f.offset = 0
+		f.partial = nil
+		f.discard = false
+		f.fp, f.fpLen = fingerprint(f.file, fingerprintLen)
+	}
+
+	changed := f.read(hf)
+
+	// Rotated (or removed): the old file has been read to the end, so switch to the file now at the path
+	info, err := os.Stat(f.path)
+	if err != nil || !os.SameFile(info, cur) {
+		log.Printf("INFO: %s was rotated", f.path)
+		f.file.Close()
+		f.file = nil
+
+		if f.open(nil) {
+			f.read(hf)
+		}
+
+		changed = true
+	}
+
+	return changed
+}
+
+// Return the position to save. An incomplete line is read again after a restart
+func (f *Follower) state() FollowState {
+	return FollowState{Offset: f.offset - int64(len(f.partial)), FPLen: f.fpLen, FP: f.fp}
+}
+
+// Read the saved offsets. A missing or unreadable file means starting afresh
+func loadFollowState(path string) map[string]FollowState {
+	state := make(map[string]FollowState)
+
+	if len(path) == 0 {
+		return state
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("ERROR: Unable to read the follow offsets: %v", err)
+		}
+
+		return state
+	}
+
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		log.Printf("ERROR: Ignoring invalid follow offsets in %s: %v", path, err)
+	}
+
+	return state
+}
+
+// Save the offsets atomically, so that a crash never leaves a partial file
+func saveFollowState(path string, state map[string]FollowState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data, followStateMode)
+}
+
+// Follow the files until ctx is cancelled, passing each new line to parseAlerts() to be decoded by dec. If statePath
+// is set the offsets are saved there after each change
+func followFiles(ctx context.Context, paths []string, statePath string, dec Decoder, hf chan<- string) {
+	state := loadFollowState(statePath)
+
+	var followers []*Follower
+	for _, path := range paths {
+		followers = append(followers, &Follower{path: strings.TrimSpace(path), dec: dec})
+	}
+
+	ticker := time.NewTicker(followPoll)
+	defer ticker.Stop()
+
+	for {
+		changed := false
+
+		for _, f := range followers {
+			var saved *FollowState
+			if s, ok := state[f.path]; ok {
+				saved = &s
+			}
+
+			if f.poll(saved, hf) {
+				state[f.path] = f.state()
+				changed = true
+			}
+		}
+
+		if changed && len(statePath) > 0 {
+			err := saveFollowState(statePath, state)
+			if err != nil {
+				log.Printf("ERROR: Unable to save the follow offsets: %v", err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			for _, f := range followers {
+				if f.file != nil {
+					f.file.Close()
+				}
+			}
+
+			return
+		}
+	}
+}
@@ -17,21 +17,21 @@
 package main
 
 import (
-	"crypto/tls"
+	"errors"
 	"sync"
 )
 
 const version string = "0.42"
 
-/* Use these for TNSR versions >= 19.02 */
-const ACL_WriteRule = "/restconf/data/netgate-acl:acl-config/acl-table/acl-list=snortblock/acl-rules"
-const ACL_ReadRules = "/restconf/data/netgate-acl:acl-config/acl-table/acl-list=snortblock/acl-rules"
-const ACL_Delete = "/restconf/data/netgate-acl:acl-config/acl-table/acl-list=snortblock/acl-rules/acl-rule="
+/* Use these for TNSR versions >= 19.02. %s is replaced by the ACL name */
+const ACL_WriteRule = "/restconf/data/netgate-acl:acl-config/acl-table/acl-list=%s/acl-rules"
+const ACL_ReadRules = "/restconf/data/netgate-acl:acl-config/acl-table/acl-list=%s/acl-rules"
+const ACL_Delete = "/restconf/data/netgate-acl:acl-config/acl-table/acl-list=%s/acl-rules/acl-rule="
 
 /* Use these for TNSR versions earlier than 19.02
-const ACL_WriteRule = "/restconf/data/acl-config/acl-table/acl-list=snortblock/acl-rules"
-const ACL_ReadRules = "/restconf/data/acl-config/acl-table/acl-list=snortblock/acl-rules/acl-rule"
-const ACL_Delete = "/restconf/data/acl-config/acl-table/acl-list=snortblock/acl-rules/acl-rule="
+const ACL_WriteRule = "/restconf/data/acl-config/acl-table/acl-list=%s/acl-rules"
+const ACL_ReadRules = "/restconf/data/acl-config/acl-table/acl-list=%s/acl-rules/acl-rule"
+const ACL_Delete = "/restconf/data/acl-config/acl-table/acl-list=%s/acl-rules/acl-rule="
 */
 const MAXCACHEAGE uint64 = 5 // Maximum permitted age of the cached rules after which it must be refreshed
 const reapPeriod string = "@every 5m"
@@ -83,12 +83,10 @@ type AAclRule struct {
 
 // Some simple globals
 var verbose = false      // Enable verbose logging to stdout
-var lastupdate uint64    // When was the cache last updated from TNSR
 var tnsrMutex sync.Mutex // Mutex so addRule() and reapACLs() don't collide
-var tnsrhost string      // Address or hostname of TNSR instance
 
-// A local copy  of the ACL rules. Certain operations are performed on the cache, which is updated automatically
-// when older that MAXCACHEAGE.
+// A local copy  of the ACL rules on the first target (other targets have their own). Certain operations are performed
+// on the cache, which is updated automatically when older that MAXCACHEAGE.
 // Checking whether a rule exists and calculating the next free sequence number could otherwise require thousands
 // of RESTCONF calls
 var aclcache ACLRuleList
@@ -96,11 +94,14 @@ var aclcache ACLRuleList
 // Maximum permitted age of the TNSR ACL rules in seconds after which they are removed via reap()
 var maxruleage uint64
 
-// Making these global allows the TLS stuff to be set up once, then used on every ESTCONF call
-var useTLS bool
+// Remove the rules added by tnsrids on exit
+var failOpen bool
 
-// TLS configuration
-var tlsConfig *tls.Config
+// The FIFO between the listener and processHosts(). Global so that its depth can be reported
+var hostQueue = make(chan string, 4096)
+
+// Returned by addRule() when a rule for the host is already installed
+var errDuplicateRule = errors.New("A block rule for this host already exists")
 
 // COnfiguration map. Used only while parsing the command line and config file
 var config map[string]string
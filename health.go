@@ -0,0 +1,185 @@
+// health.go provides /healthz and /readyz endpoints so that orchestration can see whether tnsrids is able to do its
+// job, rather than discovering a crash-looping service
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// If the last successful RESTCONF call is older than this (seconds), /readyz probes TNSR before answering
+const readyProbeAge int64 = int64(MAXCACHEAGE * 60)
+
+// The queue is considered backed up when it is more than this percentage full
+const readyQueuePct = 90
+
+// Health holds the state reported by the health endpoints. Fields are accessed atomically
+// The RESTCONF state is held by each target
+type Health struct {
+	listening int32 // 1 when the alert listener is running
+	probing   int32 // 1 while a probe is running
+}
+
+var health Health
+
+// Record whether the alert listener is running
+func (h *Health) setListening(up bool) {
+	var v int32
+	if up {
+		v = 1
+	}
+
+	atomic.StoreInt32(&h.listening, v)
+}
+
+// HealthStatus is the body returned by /healthz and /readyz
+type HealthStatus struct {
+	Ready         bool           `json:"ready"`
+	Role          string         `json:"role"` // "leader" or "standby"
+	Listening     bool           `json:"listening"`
+	LastREST      int64          `json:"last-restconf"`     // Epoch time of the oldest last successful RESTCONF call. 0 = never
+	LastRESTAge   int64          `json:"last-restconf-age"` // Seconds since the last successful RESTCONF call to the stalest target
+	CacheAge      int64          `json:"cache-age"`         // Seconds since the oldest rule cache was refreshed
+	QueueDepth    int            `json:"queue-depth"`       // Hosts waiting to be blocked
+	QueueCapacity int            `json:"queue-capacity"`
+	Panic         bool           `json:"panic"` // Automatic blocking is stopped. Does not affect readiness
+	Targets       []TargetHealth `json:"targets"`
+	Problems      []string       `json:"problems,omitempty"` // Reasons for not being ready
+}
+
+// TargetHealth is the state of a single TNSR target
+type TargetHealth struct {
+	Name        string `json:"name"`
+	Host        string `json:"host"`
+	LastREST    int64  `json:"last-restconf"`
+	CacheAge    int64  `json:"cache-age"`
+	Pending     int    `json:"pending"` // Blocks waiting to be retried on this target
+	CircuitOpen bool   `json:"circuit-open"`
+}
+
+// Collect the current health status
+func (h *Health) status() HealthStatus {
+	now := time.Now().Unix()
+
+	hs := HealthStatus{
+		Role:          role(),
+		Panic:         limiter.inPanic(),
+		Listening:     atomic.LoadInt32(&h.listening) == 1,
+		QueueDepth:    queueDepth(),
+		QueueCapacity: queueCapacity(),
+	}
+
+	// tnsrMutex is not taken, as it may be held for a long time by a RESTCONF call to an unreachable target
+	for idx, t := range currentTargets() {
+		th := TargetHealth{
+			Name:        t.Name,
+			Host:        t.Host,
+			LastREST:    atomic.LoadInt64(&t.lastREST),
+			Pending:     int(atomic.LoadInt64(&t.pendingCount)),
+			CircuitOpen: t.breaker.isOpen(),
+		}
+
+		if updated := atomic.LoadUint64(&t.lastupdate); updated > 0 {
+			th.CacheAge = now - int64(updated)
+		}
+
+		// Report the stalest target
+		if idx == 0 || th.LastREST < hs.LastREST {
+			hs.LastREST = th.LastREST
+		}
+
+		if th.CacheAge > hs.CacheAge {
+			hs.CacheAge = th.CacheAge
+		}
+
+		hs.Targets = append(hs.Targets, th)
+	}
+
+	if hs.LastREST > 0 {
+		hs.LastRESTAge = now - hs.LastREST
+	}
+
+	if !hs.Listening {
+		hs.Problems = append(hs.Problems, "Alert listener is not running")
+	}
+
+	for _, th := range hs.Targets {
+		if th.LastREST == 0 || now-th.LastREST > readyProbeAge {
+			hs.Problems = append(hs.Problems, "TNSR RESTCONF is not reachable on "+th.Name)
+		}
+
+		if th.CircuitOpen {
+			hs.Problems = append(hs.Problems, "RESTCONF circuit breaker is open for "+th.Name)
+		}
+	}
+
+	if hs.QueueDepth*100 > hs.QueueCapacity*readyQueuePct {
+		hs.Problems = append(hs.Problems, "Host queue is backed up")
+	}
+
+	hs.Ready = len(hs.Problems) == 0
+	return hs
+}
+
+// Probe each target by refreshing its rule cache if no RESTCONF call has succeeded recently. When the daemon is idle
+// there may be no other RESTCONF traffic between reaps. Runs in the background, since it may wait for tnsrMutex and
+// for an unreachable target, and only one probe runs at a time
+func (h *Health) probe() {
+	if !atomic.CompareAndSwapInt32(&h.probing, 0, 1) {
+		return
+	}
+
+	defer atomic.StoreInt32(&h.probing, 0)
+
+	now := time.Now().Unix()
+
+	tnsrMutex.Lock()
+	defer tnsrMutex.Unlock()
+
+	for _, t := range targets {
+		if now-atomic.LoadInt64(&t.lastREST) > readyProbeAge {
+			// A single attempt, so that an unreachable target does not hold tnsrMutex for long
+			ctx, cancel := context.WithTimeout(context.Background(), restTimeout)
+			t.getBlockACL(ctx, true)
+			cancel()
+		}
+	}
+}
+
+// Liveness: always 200 while the process is able to answer, with the details in the body
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, health.status())
+}
+
+// Readiness: 200 if the listener is running, TNSR is reachable and the queue is not backed up, otherwise 503
+// A stale target is probed in the background, so the answer reflects the state before the probe
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	go health.probe()
+
+	hs := health.status()
+	if !hs.Ready {
+		writeJSON(w, http.StatusServiceUnavailable, hs)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, hs)
+}
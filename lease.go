@@ -0,0 +1,270 @@
+// lease.go lets two tnsrids instances run as an active/standby pair. They share a lease file (on NFS or other
+// shared storage) holding the identity of the leader and the time its lease expires. Only the leader adds, reaps
+// or removes rules. The standby keeps its rule cache warm and takes over when the lease expires
+// The expiry time in the file is wall-clock time, so the clocks of the two hosts must be kept in step (by NTP) to
+// well within leasettl/3. The leader itself times its lease on the monotonic clock
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const dfltLeaseTTL = "30" // Seconds a lease remains valid unless renewed
+
+// Time allowed for a competing instance to overwrite the lease file before the result of a take-over is checked
+const leaseSettle = time.Second
+
+// Reference point for the monotonic times held in a Lease
+var leaseClock = time.Now()
+
+// Returned when a change is requested from the standby instance
+var errStandby = errors.New("This tnsrids instance is the standby. Changes must be made on the leader")
+
+// A Lease is this instance's view of the shared lease file
+type Lease struct {
+	path    string
+	id      string        // Identity written to the lease file: hostname:pid
+	ttl     time.Duration // Lifetime of the lease. It is renewed every ttl/3
+	held    int32         // 1 while the lease file names this instance. Accessed atomically
+	leader  int32         // 1 once the rules have been refreshed after acquiring the lease. Accessed atomically
+	taking  int32         // 1 while takeOver() is running. Accessed atomically
+	renewed int64         // Monotonic time (since leaseClock) at which the last successful renewal began. Accessed atomically
+}
+
+// The lease, or nil if high availability is not configured, in which case this instance is always the leader
+var lease *Lease
+
+// Create a lease backed by the file at path
+func newLease(path string, ttl time.Duration) (*Lease, error) {
+	if ttl < 3*time.Second {
+		return nil, fmt.Errorf("Lease TTL %v is too short. Must be at least 3s", ttl)
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Lease{path: path, id: fmt.Sprintf("%s:%d", host, os.Getpid()), ttl: ttl}, nil
+}
+
+// Returns true if this instance may change the rules in TNSR
+func isLeader() bool {
+	if lease == nil {
+		return true
+	}
+
+	return atomic.LoadInt32(&lease.leader) == 1 && lease.valid()
+}
+
+// Returns true if the lease was renewed recently enough that the other instance can not yet have taken it over
+// A renewal that stalls (on a hung NFS server, say) ends the leadership without waiting for the lease goroutine.
+// The margin of ttl/3 allows for the clocks of the two hosts differing
+func (l *Lease) valid() bool {
+	age := time.Since(leaseClock) - time.Duration(atomic.LoadInt64(&l.renewed))
+	return age < l.ttl-l.ttl/3
+}
+
+// Return "leader" or "standby"
+func role() string {
+	if isLeader() {
+		return "leader"
+	}
+
+	return "standby"
+}
+
+// Read the holder and expiry time from the lease file
+func readLease(path string) (string, time.Time, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return "", time.Time{}, fmt.Errorf("Invalid lease file %s", path)
+	}
+
+	expiry, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Invalid expiry time in lease file %s", path)
+	}
+
+	return fields[0], time.Unix(expiry, 0), nil
+}
+
+// Write the lease file atomically, so that the other instance never reads a partial file
+func (l *Lease) write(expires time.Time) error {
+	return writeFileAtomic(l.path, []byte(fmt.Sprintf("%s %d\n", l.id, expires.Unix())), 0600)
+}
+
+// Renew the lease if we hold it, or take it over if it is free or has expired. Called every ttl/3
+// Returns true if this instance holds the lease but is not yet the leader, in which case takeOver() must be called
+func (l *Lease) renew() bool {
+	now := time.Now()
+	started := time.Since(leaseClock)
+
+	holder, expiry, err := readLease(l.path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("ERROR: Unable to read the lease: %v", err)
+	}
+
+	// Another instance holds a valid lease
+	if err == nil && holder != l.id && expiry.After(now) {
+		l.standby(holder)
+		return false
+	}
+
+	taking := holder != l.id
+	expires := now.Add(l.ttl)
+
+	err = l.write(expires)
+	if err != nil {
+		log.Printf("ERROR: Unable to write the lease: %v", err)
+
+		// isLeader() already returns false once the lease is close to expiry. Record the change of role
+		if !l.valid() {
+			l.standby("")
+		}
+
+		return false
+	}
+
+	// When taking over, give a competing instance time to write the file too, and see who won
+	if taking {
+		time.Sleep(leaseSettle)
+
+		holder, _, err = readLease(l.path)
+		if err != nil || holder != l.id {
+			l.standby(holder)
+			return false
+		}
+	}
+
+	// If the lease lapsed before this renewal, the other instance may have changed the rules meanwhile
+	if !l.valid() {
+		atomic.StoreInt32(&l.leader, 0)
+	}
+
+	atomic.StoreInt64(&l.renewed, int64(started))
+	return atomic.SwapInt32(&l.held, 1) == 0 || atomic.LoadInt32(&l.leader) == 0
+}
+
+// Record the loss of the lease
+func (l *Lease) standby(holder string) {
+	if atomic.SwapInt32(&l.held, 0) == 0 {
+		return
+	}
+
+	atomic.StoreInt32(&l.leader, 0)
+	log.Printf("INFO: Running as standby. The lease is held by \"%s\"", holder)
+}
+
+// Become the leader after acquiring the lease. The rule caches are refreshed before any change is accepted, so that
+// rules added by the previous leader are not duplicated. This may wait for tnsrMutex and for TNSR, so the lease
+// goroutine runs it in the background to keep renewing the lease meanwhile
+func (l *Lease) takeOver() {
+	if !atomic.CompareAndSwapInt32(&l.taking, 0, 1) {
+		return
+	}
+
+	defer atomic.StoreInt32(&l.taking, 0)
+
+	tnsrMutex.Lock()
+	defer tnsrMutex.Unlock()
+
+	err := getSnortBlockACL(context.Background(), true)
+	if err != nil {
+		log.Printf("ERROR: Unable to refresh the rules after acquiring the lease: %v", err)
+
+		// Make sure the caches are read again before they are used
+		for _, t := range targets {
+			t.noteCache(0)
+		}
+	}
+
+	// The lease may have been lost while the rules were read
+	if atomic.LoadInt32(&l.held) == 0 || !l.valid() {
+		return
+	}
+
+	atomic.StoreInt32(&l.leader, 1)
+	log.Printf("INFO: Acquired the lease. Running as leader")
+
+	// Carry on with the blocks that the previous leader was retrying
+	loadPending()
+}
+
+// Refresh the rule caches while running as standby, so that little has to be read from TNSR on taking over.
+// Run periodically from cron
+func warmStandbyCache() {
+	if isLeader() {
+		return
+	}
+
+	tnsrMutex.Lock()
+	defer tnsrMutex.Unlock()
+
+	err := getSnortBlockACL(context.Background(), false)
+	if err != nil {
+		log.Printf("ERROR: Standby unable to refresh the rules: %v", err)
+	}
+}
+
+// Renew the lease until ctx is cancelled
+func (l *Lease) run(ctx context.Context) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if l.renew() {
+				go l.takeOver()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Give up the lease on shutdown so that the standby can take over straight away
+func (l *Lease) release() {
+	atomic.StoreInt32(&l.leader, 0)
+	if atomic.SwapInt32(&l.held, 0) == 0 {
+		return
+	}
+
+	holder, _, err := readLease(l.path)
+	if err == nil && holder == l.id {
+		os.Remove(l.path)
+		log.Printf("INFO: Released the lease")
+	}
+}
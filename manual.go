@@ -0,0 +1,197 @@
+// manual.go implements the -block and -unblock command line modes which allow an operator to add or remove
+// block rules by hand, for example to release a false positive without having to look up the sequence number
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An InputError is returned by blockHost() and unblockHost() when the request itself is invalid, as opposed to TNSR
+// being unreachable or refusing the change
+type InputError struct {
+	Err error
+}
+
+func (e *InputError) Error() string {
+	return e.Err.Error()
+}
+
+// Returned by unblockHost() when there is no rule to remove
+var errNoRule = errors.New("No block rule found")
+
+// Convert an address or prefix to the form used in the ACL rules. A bare address becomes a host prefix
+func normalizePrefix(host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			return ip.String() + "/32", nil
+		}
+
+		return ip.String() + "/128", nil
+	}
+
+	_, ipnet, err := net.ParseCIDR(host)
+	if err != nil {
+		return "", fmt.Errorf("\"%s\" is not a valid address or prefix", host)
+	}
+
+	return ipnet.String(), nil
+}
+
+// Identify the operator running the command so that manual changes can be audited
+// When run via sudo, the invoking user is more interesting than root
+func operatorName() string {
+	if name := os.Getenv("SUDO_USER"); len(name) > 0 {
+		return name
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return "unknown"
+	}
+
+	return u.Username
+}
+
+// Add a block rule for the specified prefix. duration is the lifetime of the rule in minutes (or a duration string).
+// An empty duration means the rule is reaped after maxruleage, like any other rule. who identifies the operator
+func blockHost(host string, duration string, reason string, who string) error {
+	var expires uint64
+
+	prefix, err := normalizePrefix(host)
+	if err != nil {
+		return &InputError{err}
+	}
+
+	if len(duration) > 0 {
+		d, err := parseDuration(duration, time.Minute)
+		if err != nil || d < time.Second {
+			return &InputError{fmt.Errorf("Invalid duration \"%s\". Must be a number of minutes > 0", duration)}
+		}
+
+		expires = uint64(time.Now().Add(d).Unix())
+	}
+
+	err = addRule(context.Background(), prefix, true, expires, "(manual)")
+	if err != nil {
+		return err
+	}
+
+	log.Printf("INFO: Block rule for \"%s\" added manually by %s. Reason: %s", prefix, who, reason)
+	return nil
+}
+
+// Remove a block rule, specified either by sequence number or by the address/prefix it blocks, from every target
+// Sequence numbers differ between targets, so a sequence number identifies the prefix blocked by that rule on the
+// first target, and the rules for that prefix are removed
+func unblockHost(target string, reason string, who string) error {
+	var errs []string
+
+	ctx := context.Background()
+
+	tnsrMutex.Lock()
+	defer tnsrMutex.Unlock()
+
+	if !isLeader() {
+		return errStandby
+	}
+
+	seq, err := strconv.ParseUint(target, 10, 64)
+	if err == nil {
+		if seq > maxSeqNum {
+			return &InputError{errors.New("Refusing to delete the default permit rule")}
+		}
+
+		err = targets[0].getBlockACL(ctx, false)
+		if err != nil {
+			return err
+		}
+
+		target = targets[0].cache.prefix(seq)
+		if len(target) == 0 {
+			return fmt.Errorf("%w with sequence %d", errNoRule, seq)
+		}
+	}
+
+	prefix, err := normalizePrefix(target)
+	if err != nil {
+		return &InputError{err}
+	}
+
+	// Remove the rule from every target that can be reached, and make sure it is not added later by a retry
+	found := false
+	for _, t := range targets {
+		t.dropPending(prefix)
+
+		err = t.getBlockACL(ctx, true)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", t.Name, err))
+			continue
+		}
+
+		seq = t.cache.sequence(prefix)
+		if seq == 0 || seq > maxSeqNum {
+			continue
+		}
+
+		found = true
+
+		err = removeRule(ctx, t, seq, target, reason, who)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", t.Name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	if !found {
+		return fmt.Errorf("%w for \"%s\"", errNoRule, prefix)
+	}
+
+	return nil
+}
+
+// Delete a rule from a target and log who removed it. Must be called with tnsrMutex held
+func removeRule(ctx context.Context, t *Target, seq uint64, target string, reason string, who string) error {
+	err := t.getBlockACL(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	err = t.deleteRule(ctx, seq)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("INFO: Rule with sequence %d (%s) removed from %s manually by %s. Reason: %s", seq, target, t.Name, who, reason)
+
+	// Re-read the ACL so that the cache is up to date
+	return t.getBlockACL(ctx, true)
+}
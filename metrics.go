@@ -0,0 +1,210 @@
+// metrics.go exposes the daemon counters, RESTCONF latency and queue depth in the Prometheus text exposition
+// format. The format is simple enough that the Prometheus client library is not needed
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds (in seconds) of the RESTCONF latency histogram buckets
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Escapes the characters that may not appear in a label value of the text exposition format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Return a label value escaped for the exposition format. Target names come from the configuration and may contain
+// anything
+func labelValue(val string) string {
+	return labelEscaper.Replace(val)
+}
+
+// A histSeries is one labelled series of a histogram
+type histSeries struct {
+	counts []uint64 // Per bucket (not cumulative)
+	count  uint64
+	sum    float64
+}
+
+// A Histogram records observations in buckets, with one series per method/status label pair
+type Histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	series  map[[2]string]*histSeries
+}
+
+// Latency of rest() calls by HTTP method and status code
+var restLatency = Histogram{buckets: latencyBuckets}
+
+// Record an observation of v seconds for the method and status
+func (h *Histogram) observe(method string, status string, v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.series == nil {
+		h.series = make(map[[2]string]*histSeries)
+	}
+
+	key := [2]string{method, status}
+	s := h.series[key]
+	if s == nil {
+		s = &histSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+
+	for idx, b := range h.buckets {
+		if v <= b {
+			s.counts[idx]++
+			break
+		}
+	}
+
+	s.count++
+	s.sum += v
+}
+
+// Write the histogram in Prometheus text format
+func (h *Histogram) write(w io.Writer, name string, help string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+
+	// Sort the series so that the output is stable
+	keys := make([][2]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || (keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+	})
+
+	for _, k := range keys {
+		s := h.series[k]
+		labels := fmt.Sprintf("method=\"%s\",status=\"%s\"", labelValue(k[0]), labelValue(k[1]))
+
+		var cumulative uint64
+		for idx, b := range h.buckets {
+			cumulative += s.counts[idx]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(b, 'g', -1, 64), cumulative)
+		}
+
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, s.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, s.count)
+	}
+}
+
+// Write a single counter or gauge in Prometheus text format
+func writeMetric(w io.Writer, name string, kind string, help string, v interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, v)
+}
+
+// Convert a boolean to a gauge value
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// Record the latency of a RESTCONF call started at start. A status of 0 means the call failed to complete
+func observeREST(method string, status int, start time.Time) {
+	label := "error"
+	if status != 0 {
+		label = strconv.Itoa(status)
+	}
+
+	restLatency.observe(method, label, time.Since(start).Seconds())
+}
+
+// Serve the metrics
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	s := stats.snapshot()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetric(w, "tnsrids_alerts_received_total", "counter", "Alert messages received", s.AlertsReceived)
+	writeMetric(w, "tnsrids_alerts_parsed_total", "counter", "Alert messages from which a host was extracted", s.AlertsParsed)
+	writeMetric(w, "tnsrids_alerts_rejected_total", "counter", "Alert messages from which no host could be extracted", s.AlertsRejected)
+	writeMetric(w, "tnsrids_alerts_dropped_total", "counter", "Blocks discarded because the spool was full", s.AlertsDropped)
+	writeMetric(w, "tnsrids_alerts_denied_total", "counter", "Alert messages from senders that are not permitted sensors", s.AlertsDenied)
+	writeMetric(w, "tnsrids_alerts_unauthenticated_total", "counter", "Alert messages that were unsigned, forged, stale or replayed", s.AlertsUnauthenticated)
+	writeMetric(w, "tnsrids_rules_added_total", "counter", "Block rules added to TNSR", s.RulesAdded)
+	writeMetric(w, "tnsrids_rules_duplicate_total", "counter", "Alerts for hosts that were already blocked", s.RulesDuplicate)
+	writeMetric(w, "tnsrids_rules_failed_total", "counter", "Block rules that could not be added", s.RulesFailed)
+	writeMetric(w, "tnsrids_rules_reaped_total", "counter", "Block rules removed after reaching their maximum age", s.RulesReaped)
+	writeMetric(w, "tnsrids_rules_standby_total", "counter", "Blocks not added because this instance is the standby", s.RulesStandby)
+	writeMetric(w, "tnsrids_leader", "gauge", "1 while this instance is the leader", boolMetric(isLeader()))
+	writeMetric(w, "tnsrids_blocks_suppressed_total", "counter", "Blocks not added because of the rate limits or a panic", s.BlocksSuppressed)
+	writeMetric(w, "tnsrids_panic", "gauge", "1 while automatic blocking is stopped by the panic threshold", boolMetric(limiter.inPanic()))
+	writeMetric(w, "tnsrids_queue_depth", "gauge", "Hosts waiting to be blocked", queueDepth())
+	writeMetric(w, "tnsrids_queue_capacity", "gauge", "Capacity of the host queue", queueCapacity())
+	writeTargetMetrics(w)
+	restLatency.write(w, "tnsrids_restconf_duration_seconds", "Latency of RESTCONF calls to TNSR")
+	writeCertMetrics(w)
+}
+
+// Write the gauges that are labelled by target
+func writeTargetMetrics(w io.Writer) {
+	var rules, pending, open []string
+
+	for _, t := range currentTargets() {
+		name := labelValue(t.Name)
+		rules = append(rules, fmt.Sprintf("tnsrids_rules{target=\"%s\"} %d\n", name, atomic.LoadInt64(&t.ruleCount)))
+		pending = append(pending, fmt.Sprintf("tnsrids_pending_blocks{target=\"%s\"} %d\n", name, atomic.LoadInt64(&t.pendingCount)))
+		open = append(open, fmt.Sprintf("tnsrids_restconf_circuit_open{target=\"%s\"} %d\n", name, boolMetric(t.breaker.isOpen())))
+	}
+
+	fmt.Fprintf(w, "# HELP tnsrids_rules Rules currently in the ACL cache\n# TYPE tnsrids_rules gauge\n%s", strings.Join(rules, ""))
+	fmt.Fprintf(w, "# HELP tnsrids_pending_blocks Blocks waiting to be retried\n# TYPE tnsrids_pending_blocks gauge\n%s", strings.Join(pending, ""))
+	fmt.Fprintf(w, "# HELP tnsrids_restconf_circuit_open 1 while TNSR is considered unreachable\n# TYPE tnsrids_restconf_circuit_open gauge\n%s", strings.Join(open, ""))
+}
+
+// Serve the metrics (and health endpoints) on their own listener, for when they need to be reachable from a different address than the API
+func startMetrics(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+
+	log.Printf("INFO: Metrics listening on %s", addr)
+
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: apiHeaderTimeout}
+
+	go func() {
+		err := srv.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Printf("ERROR: Metrics listener stopped: %v", err)
+		}
+	}()
+
+	return srv
+}
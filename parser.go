@@ -1,4 +1,4 @@
-// parser.go extracts the host we need to block from a Snort alert message and puts it onto channel
+// parser.go extracts the host we need to block from an alert message and puts it onto channel
 // The Go routine processHosts() reads the hosts from the channel and updates the ACL
 
 /* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
@@ -20,18 +20,102 @@
 package main
 
 import (
+	"context"
 	//	"fmt"
+	"log"
 	"regexp"
+	"strings"
 	//	"time"
 )
 
-// Go routine to continuously reads host names channel and pass them to the ACL updater
-func processHosts(hf <-chan string) {
+// Go routine to continuously reads host names channel (or the spool if enabled) and pass them to the ACL updater
+// If TNSR can not be reached the host is retried once it can, so the pipeline pauses rather than losing blocks
+// Once ctx is cancelled the hosts remaining in the channel are drained (spooled hosts are already safe on disk)
+// and finished is closed. deadline is cancelled when the time allowed for draining has passed, which interrupts any
+// RESTCONF call in progress
+func processHosts(ctx context.Context, deadline context.Context, hf <-chan string, finished chan<- struct{}) {
+	defer close(finished)
+
+	for {
+		id, host, ok := nextHost(ctx, hf)
+		if !ok || deadline.Err() != nil {
+			return
+		}
+
+		if blockWithRetry(ctx, deadline, host) && spool != nil {
+			spool.done(id)
+		}
+	}
+}
+
+// Return the next host to block. ok is false once there is nothing more to do after a shutdown request
+func nextHost(ctx context.Context, hf <-chan string) (id uint64, host string, ok bool) {
+	if spool != nil {
+		if ctx.Err() != nil {
+			return 0, "", false
+		}
+
+		return spool.next(ctx)
+	}
+
+	select {
+	case host = <-hf:
+		return 0, host, true
+	case <-ctx.Done():
+	}
+
+	// Shutting down. Drain whatever is left in the channel
+	select {
+	case host = <-hf:
+		return 0, host, true
+	default:
+		return 0, "", false
+	}
+}
+
+// Add a block rule for the host, waiting for TNSR if it is unreachable. Returns false if the block could not be
+// added before shutdown. The host may be followed by the name of the sensor that reported it, which is recorded in
+// the rule description. The RESTCONF calls are abandoned when deadline is cancelled
+func blockWithRetry(ctx context.Context, deadline context.Context, host string) bool {
+	comment, sensor := "", ""
+	if f := strings.Fields(host); len(f) == 2 {
+		host, sensor, comment = f[0], f[1], "(sensor "+f[1]+")"
+	}
+
+	// Only new blocks count towards the rate limits. The standby counts its blocks in addRule()
+	if isLeader() && !isBlocked(host) && !limiter.allow(host, sensor) {
+		return true
+	}
+
 	for {
-		addRule(<-hf, true)
+		err := addRule(deadline, host, true, 0, comment)
+		if err != nil && deadline.Err() != nil {
+			log.Printf("ERROR: Shutdown deadline reached. Abandoning block for \"%s\"", host)
+			return false
+		}
+
+		if err == nil || !retryable(err) {
+			return true
+		}
+
+		if ctx.Err() != nil {
+			log.Printf("ERROR: Shutting down. Abandoning block for \"%s\": %v", host, err)
+			return false
+		}
+
+		log.Printf("INFO: Block for \"%s\" queued for retry: %v", host, err)
+		waitForTargets(ctx)
 	}
 }
 
+// Returns true if there is already a rule for the host in the cache of the first target
+func isBlocked(host string) bool {
+	tnsrMutex.Lock()
+	defer tnsrMutex.Unlock()
+
+	return ruleExists(host)
+}
+
 // Extract the first IPv4 address from a string
 func findIP(input string) string {
 	numBlock := "(25[0-5]|2[0-4][0-9]|1[0-9][0-9]|[1-9]?[0-9])"
@@ -41,8 +125,50 @@ func findIP(input string) string {
 	return regEx.FindString(input)
 }
 
-// parseAlerts processes incoming syslog records and pushes the host to block into a channel read by peocessHosts
-func parseAlerts(alert string, hf chan<- string) {
-	addr := findIP(alert)
-	hf <- addr + "/32"
+// parseAlerts processes incoming alert messages and pushes the host to block into a channel read by peocessHosts
+// Messages that dec can not decode are counted as rejected. sensor identifies where the message came from
+func parseAlerts(msg string, sensor string, dec Decoder, hf chan<- string) {
+	alert, ok := dec.Decode(msg)
+	if !ok {
+		alert = Alert{Format: dec.Name()}
+	}
+
+	alert.Sensor = sensor
+
+	queueAlert(alert, msg, hf)
+}
+
+// queueAlert pushes the attacker from a decoded alert into the channel (or the spool). msg is the alert as received,
+// for the record of recent alerts. Hosts reported by a remote sensor are queued as "<prefix> <sensor>"
+func queueAlert(alert Alert, msg string, hf chan<- string) {
+	count(&stats.AlertsReceived)
+	recentAlerts.add(alert, msg)
+
+	if len(alert.Attacker) == 0 {
+		count(&stats.AlertsRejected)
+		return
+	}
+
+	prefix, err := normalizePrefix(alert.Attacker)
+	if err != nil {
+		count(&stats.AlertsRejected)
+		return
+	}
+
+	count(&stats.AlertsParsed)
+
+	if len(alert.Sensor) > 0 && alert.Sensor != localSensor {
+		prefix += " " + alert.Sensor
+	}
+
+	if spool != nil {
+		err := spool.push(prefix)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+		}
+
+		return
+	}
+
+	hf <- prefix
 }
@@ -0,0 +1,186 @@
+// patterns.go decodes the alerts of other tools (home-grown scanners, brute-force detectors and the like) using
+// regular expressions from the config file. Named groups in each expression pick out the attacker, the victim, the
+// signature and the severity, and the expressions are tried in the order they are listed
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+const fmtRegex = "regex" // Matched by one of the user's patterns
+
+// Names of the groups a pattern may capture. attacker is required
+var patternGroups = []string{"attacker", "victim", "signature", "severity"}
+
+// A Pattern is a user-defined regular expression for the alerts of some tool
+type Pattern struct {
+	Name      string
+	re        *regexp.Regexp
+	signature string // Used if the expression has no signature group. Defaults to the name
+	severity  int    // Used if the expression has no severity group
+}
+
+// The patterns, in configuration order. The slice is replaced (not modified) on reload
+var patterns []*Pattern
+var patternMutex sync.Mutex
+
+// Return the current list of patterns
+func currentPatterns() []*Pattern {
+	patternMutex.Lock()
+	defer patternMutex.Unlock()
+
+	return patterns
+}
+
+// Replace the patterns
+func setPatterns(list []*Pattern) {
+	patternMutex.Lock()
+	defer patternMutex.Unlock()
+
+	patterns = list
+}
+
+// Compile the patterns listed in the "patterns" section of a YAML config file. Each has a regex and optionally
+// a name, and a signature and severity to use when the regex does not capture them
+func compilePatterns(section *yaml.Node) ([]*Pattern, error) {
+	var list []*Pattern
+	var configs []map[string]string
+
+	if section == nil {
+		return nil, nil
+	}
+
+	err := section.Decode(&configs)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid patterns section (line %d): %v", section.Line, err)
+	}
+
+	for idx, pc := range configs {
+		p := &Pattern{Name: pc["name"]}
+		if len(p.Name) == 0 {
+			p.Name = fmt.Sprintf("pattern%d", idx+1)
+		}
+
+		for k, v := range pc {
+			switch strings.ToLower(k) {
+			case "name":
+			case "regex":
+				p.re, err = regexp.Compile(v)
+				if err != nil {
+					return nil, fmt.Errorf("Pattern %s: %v", p.Name, err)
+				}
+			case "signature":
+				p.signature = v
+			case "severity":
+				p.severity, err = strconv.Atoi(v)
+				if err != nil {
+					return nil, fmt.Errorf("Pattern %s: invalid severity \"%s\"", p.Name, v)
+				}
+			default:
+				return nil, fmt.Errorf("Pattern %s: unknown option \"%s\"", p.Name, k)
+			}
+		}
+
+		if p.re == nil {
+			return nil, fmt.Errorf("Pattern %s: no regex", p.Name)
+		}
+
+		if p.re.SubexpIndex("attacker") < 0 {
+			return nil, fmt.Errorf("Pattern %s: the regex must capture the attacker with (?P<attacker>...)", p.Name)
+		}
+
+		for _, group := range p.re.SubexpNames() {
+			if len(group) > 0 && !contains(patternGroups, group) {
+				return nil, fmt.Errorf("Pattern %s: unknown group \"%s\". Use %s", p.Name, group, strings.Join(patternGroups, ", "))
+			}
+		}
+
+		if len(p.signature) == 0 {
+			p.signature = p.Name
+		}
+
+		list = append(list, p)
+	}
+
+	return list, nil
+}
+
+// Decode a message with the first pattern that matches it and captures a valid attacker address
+func parsePatterns(msg string) (Alert, bool) {
+	for _, p := range currentPatterns() {
+		a, ok := p.match(msg)
+		if ok {
+			return a, true
+		}
+	}
+
+	return Alert{}, false
+}
+
+// Decode a message with the pattern
+func (p *Pattern) match(msg string) (Alert, bool) {
+	m := p.re.FindStringSubmatch(msg)
+	if m == nil {
+		return Alert{}, false
+	}
+
+	group := func(name string) string {
+		if idx := p.re.SubexpIndex(name); idx >= 0 {
+			return strings.TrimSpace(m[idx])
+		}
+
+		return ""
+	}
+
+	a := Alert{Format: fmtRegex, Attacker: group("attacker"), Dst: group("victim"), Signature: group("signature"), Severity: p.severity}
+	if net.ParseIP(a.Attacker) == nil {
+		return Alert{}, false
+	}
+
+	a.Src = a.Attacker
+
+	if len(a.Signature) == 0 {
+		a.Signature = p.signature
+	}
+
+	if sev, err := strconv.Atoi(group("severity")); err == nil {
+		a.Severity = sev
+	}
+
+	return a, true
+}
+
+// Returns true if the list contains s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
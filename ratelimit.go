@@ -0,0 +1,204 @@
+// ratelimit.go limits how fast rules are added for alerts, so that alerts with spoofed sources can not make tnsrids
+// block large numbers of legitimate hosts. New blocks are limited globally and per sensor, and if too many are
+// requested at once automatic blocking stops until an operator resumes it. Suppressed blocks are logged and kept
+// for the management API. Blocks added by an operator are never limited
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const rateWindow = time.Minute // Period over which the limits are counted
+const maxSuppressed = 100      // Number of suppressed blocks remembered for the management API
+
+// The sensorrate bucket shared by the senders that are not listed in the sensors section. They are identified only
+// by their address, so a spoofed sender could otherwise have a bucket for every address it claims
+const otherSensors = "*"
+
+// Reasons for suppressing a block
+const (
+	suppressPanic  = "panic"
+	suppressGlobal = "global rate limit"
+	suppressSensor = "sensor rate limit"
+)
+
+// A SuppressedBlock is a block that was not added because of the limits
+type SuppressedBlock struct {
+	Time   int64  `json:"time"`
+	Host   string `json:"host"`
+	Sensor string `json:"sensor"`
+	Reason string `json:"reason"`
+}
+
+// A RateLimiter counts the new blocks requested and added in the last rateWindow
+type RateLimiter struct {
+	mutex     sync.Mutex
+	global    int // New blocks per minute. 0 = unlimited
+	perSensor int // New blocks per minute from each sensor, unless set for the sensor. 0 = unlimited
+	panicAt   int // Requests for new blocks per minute at which automatic blocking stops. 0 = never
+
+	requested []time.Time            // New blocks requested, whether added or suppressed. Only kept if panicAt > 0
+	added     []time.Time            // New blocks added
+	bySensor  map[string][]time.Time // New blocks added for each sensor
+	swept     time.Time              // When the idle sensors were last removed from bySensor
+	panicking bool
+
+	suppressed []SuppressedBlock // Ring buffer of the most recently suppressed blocks
+	next       int
+}
+
+var limiter = RateLimiter{bySensor: make(map[string][]time.Time)}
+
+// Set the limits
+func (l *RateLimiter) set(global int, perSensor int, panicAt int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.global = global
+	l.perSensor = perSensor
+	l.panicAt = panicAt
+
+	if panicAt == 0 {
+		l.requested = nil
+	}
+}
+
+// Remove the times that are outside the window
+func prune(times []time.Time, now time.Time) []time.Time {
+	idx := 0
+	for idx < len(times) && now.Sub(times[idx]) >= rateWindow {
+		idx++
+	}
+
+	return times[idx:]
+}
+
+// Returns true if a new block for host, reported by sensor, may be added now. Otherwise the block is recorded as
+// suppressed. Exceeding the panic threshold stops all automatic blocking
+func (l *RateLimiter) allow(host string, sensor string) bool {
+	if len(sensor) == 0 {
+		sensor = localSensor
+	}
+
+	limit, ok := sensorRate(sensor)
+
+	bucket := sensor
+	if !knownSensor(sensor) {
+		bucket = otherSensors
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !ok {
+		limit = l.perSensor
+	}
+
+	now := time.Now()
+	if l.panicAt > 0 {
+		l.requested = append(prune(l.requested, now), now)
+	}
+
+	l.added = prune(l.added, now)
+	l.bySensor[bucket] = prune(l.bySensor[bucket], now)
+
+	// Sensors that have stopped sending are removed once per window
+	if now.Sub(l.swept) >= rateWindow {
+		for s, times := range l.bySensor {
+			if len(prune(times, now)) == 0 {
+				delete(l.bySensor, s)
+			}
+		}
+
+		l.swept = now
+	}
+
+	if l.panicAt > 0 && !l.panicking && len(l.requested) > l.panicAt {
+		l.panicking = true
+		log.Printf("ERROR: %d new blocks requested in the last minute, more than the panic threshold of %d. Automatic blocking is stopped until it is resumed through the management API", len(l.requested), l.panicAt)
+	}
+
+	switch {
+	case l.panicking:
+		l.suppress(now, host, sensor, suppressPanic)
+		return false
+	case l.global > 0 && len(l.added) >= l.global:
+		l.suppress(now, host, sensor, suppressGlobal)
+		return false
+	case limit > 0 && len(l.bySensor[bucket]) >= limit:
+		l.suppress(now, host, sensor, suppressSensor)
+		return false
+	}
+
+	l.added = append(l.added, now)
+	l.bySensor[bucket] = append(l.bySensor[bucket], now)
+	return true
+}
+
+// Record a suppressed block. Must be called with the mutex held
+func (l *RateLimiter) suppress(now time.Time, host string, sensor string, reason string) {
+	count(&stats.BlocksSuppressed)
+	log.Printf("INFO: Suppressed block for \"%s\" from sensor %s: %s", host, sensor, reason)
+
+	sb := SuppressedBlock{Time: now.Unix(), Host: host, Sensor: sensor, Reason: reason}
+
+	if len(l.suppressed) < maxSuppressed {
+		l.suppressed = append(l.suppressed, sb)
+		return
+	}
+
+	l.suppressed[l.next] = sb
+	l.next = (l.next + 1) % maxSuppressed
+}
+
+// Return the suppressed blocks, oldest first
+func (l *RateLimiter) list() []SuppressedBlock {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	list := make([]SuppressedBlock, 0, len(l.suppressed))
+	list = append(list, l.suppressed[l.next:]...)
+	list = append(list, l.suppressed[:l.next]...)
+	return list
+}
+
+// Returns true while automatic blocking is stopped
+func (l *RateLimiter) inPanic() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.panicking
+}
+
+// Resume automatic blocking after a panic. who is recorded in the log
+func (l *RateLimiter) resume(who string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.panicking {
+		return
+	}
+
+	l.panicking = false
+	l.requested = nil
+	log.Printf("INFO: Automatic blocking resumed by %s", who)
+}
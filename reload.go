@@ -0,0 +1,62 @@
+// reload.go re-reads the configuration file when tnsrids receives SIGHUP, applying the settings that can be changed
+// while running and reporting those that need a restart
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// Options that are only read at start-up. Changing them requires a restart
+var restartOptions = []string{"port", "spool", "spoolmax", "overflow", "drain", "api", "apiremote", "metrics", "lease", "leasettl", "alertformat", "follow", "followstate", "followformat", "u2dir", "u2base", "u2waldo"}
+
+// Re-read the configuration and apply it. current holds the options in effect, and the options now in effect
+// are returned. If the new configuration is invalid, nothing is changed
+func reloadConfig(cfg *Config, current map[string]string) map[string]string {
+	log.Printf("INFO: Reloading configuration")
+
+	options := cfg.read()
+
+	if errs := cfg.errors(); len(errs) > 0 {
+		log.Printf("ERROR: Configuration reload failed with %d errors. Keeping current settings", len(errs))
+		return current
+	}
+
+	err := applyOptions(options, cfg.file.sections)
+	if err != nil {
+		log.Printf("ERROR: Configuration reload failed. Keeping current settings: %v", err)
+		if verbose {
+			fmt.Printf("Configuration reload failed: %v\n", err)
+		}
+
+		return current
+	}
+
+	// Report the settings which could not be applied, and remember that the old values are still in effect
+	for _, name := range restartOptions {
+		if options[name] != current[name] {
+			log.Printf("INFO: Change to \"%s\" (\"%s\" -> \"%s\") will take effect after a restart", name, current[name], options[name])
+			options[name] = current[name]
+		}
+	}
+
+	log.Printf("INFO: Configuration reloaded")
+	return options
+}
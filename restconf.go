@@ -18,6 +18,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -28,107 +29,164 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
-// Update the cached rules from the "snortblock" ACL in TNSR
+// Update the cached rules of every target
+// If a cache is < MAXCACHEAGE minutes old, don't bother UNLESS force is true. Must be called with tnsrMutex held
+func getSnortBlockACL(ctx context.Context, force bool) error {
+	var errs []string
+
+	for _, t := range targets {
+		err := t.getBlockACL(ctx, force)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", t.Name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// Update the cached rules from the target's ACL in TNSR
 // If the cache is < MAXCACHEAGE minutes old, don't bother UNLESS force is true
-func getSnortBlockACL(force bool) error {
+func (t *Target) getBlockACL(ctx context.Context, force bool) error {
 	now := time.Now()
 
-	if !force && (lastupdate+(MAXCACHEAGE*60)) > uint64(now.Unix()) {
+	if !force && (t.lastupdate+(MAXCACHEAGE*60)) > uint64(now.Unix()) {
 		return nil
 	}
 
 	if verbose {
-		fmt.Println("Updating ACL cache")
+		fmt.Printf("Updating ACL cache for %s\n", t.Name)
 	}
 
-	response, err := rest("GET", tnsrhost+ACL_ReadRules, "")
+	response, err := t.rest(ctx, "GET", fmt.Sprintf(ACL_ReadRules, t.ACL), "")
 	if err != nil {
 		return err
 	}
 
 	// Write the received JSON rule list to the local cache
-	err = json.Unmarshal(response, &aclcache)
+	var rules ACLRuleList
+	err = json.Unmarshal(response, &rules)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
+	*t.cache = rules
+
 	// And remember when
-	lastupdate = uint64(now.Unix())
+	t.noteCache(uint64(now.Unix()))
 	return nil
 }
 
-// Print a pretty list of the rules in an ACL
-func (c ACLRuleList) listACLs() {
-	log.Printf("INFO: Listing ACL block rules for snortblock ACL")
+// Add a rule to the ACL on every target. src indicates source rule or destination
+// expires is the epoch time at which the rule should be reaped (0 = use maxruleage) and comment is appended
+// to the rule description
+// If the rule could not be added to any target the error is returned so that the caller can try again later.
+// Otherwise the targets that failed are left to retryPendingBlocks(), so the rule is not duplicated on the others
+func addRule(ctx context.Context, host string, src bool, expires uint64, comment string) error {
+	var added, duplicates int
+	var failed []*Target
+	var lastErr error
 
-	idx := 0
-	var dstsrc string
-	var addr string
+	tnsrMutex.Lock()
+	defer tnsrMutex.Unlock()
 
-	for _, v := range c.AclRule {
-		var r AAclRule = v
+	// Only the leader writes to TNSR
+	if !isLeader() {
+		count(&stats.RulesStandby)
+		return errStandby
+	}
 
-		if len(r.DstIPPrefix) == 0 {
-			dstsrc = "Src IP"
-			addr = r.SrcIPPrefix
-		} else {
-			dstsrc = "Dst IP"
-			addr = r.DstIPPrefix
+	// Every target records the same creation time, which a retry keeps
+	created := uint64(time.Now().Unix())
+
+	for _, t := range targets {
+		err := t.addRule(ctx, host, src, created, expires, comment)
+		switch {
+		case err == nil:
+			added++
+		case err == errDuplicateRule:
+			duplicates++
+		case retryable(err):
+			failed = append(failed, t)
+			lastErr = err
+		default:
+			// TNSR rejected the rule. Trying again will not help
+			if lastErr == nil {
+				lastErr = err
+			}
 		}
+	}
 
-		fmt.Printf("%3d Sequence #: %10d, %s %18s, Action: %7s, Description: %s\n",
-			idx, r.Sequence, dstsrc, addr, r.Action, r.AclRuleDescription)
+	if duplicates == len(targets) {
+		count(&stats.RulesDuplicate)
+		return errDuplicateRule
+	}
 
-		idx++
+	if added == 0 && duplicates == 0 {
+		count(&stats.RulesFailed)
+		return lastErr
 	}
-}
 
-// Retrieve the rules from the snortblock ACL and print them to the console
-func showACLs() error {
-	err := getSnortBlockACL(false)
-	if err != nil {
-		return err
+	for _, t := range failed {
+		log.Printf("INFO: Block for \"%s\" on %s queued for retry", host, t.Name)
+		t.queueRetry(pendingBlock{host, src, created, expires, comment})
+	}
+
+	// Saved before the caller removes the block from the spool
+	if len(failed) > 0 {
+		savePending()
+	}
+
+	if added > 0 {
+		count(&stats.RulesAdded)
 	}
 
-	fmt.Println("\nCurrently installed rules in ACL list \"snortblock\"\n--------------------------------------------------")
-	aclcache.listACLs()
 	return nil
 }
 
-// Add a rule to the snortblock ACL in TNSR and in local cache. src indicates source rule or destination
-func addRule(host string, src bool) {
+// Add a rule to the target's ACL and to its cache. created is the epoch time recorded as the rule's creation time, from
+// which it is reaped after maxruleage. Must be called with tnsrMutex held
+func (t *Target) addRule(ctx context.Context, host string, src bool, created uint64, expires uint64, comment string) error {
 
 	var rule AAclRule
 
-	tnsrMutex.Lock()
-	defer tnsrMutex.Unlock()
-
-	err := getSnortBlockACL(false)
+	err := t.getBlockACL(ctx, false)
 	if err != nil {
-		log.Fatal("Unable to snortblock read rues from TNSR\n")
+		log.Printf("ERROR: Unable to read %s rules from TNSR %s: %v", t.ACL, t.Name, err)
+		return err
 	}
 
 	// Don't duplicate rules
-	if ruleExists(host) {
+	if t.cache.exists(host) {
 		if verbose {
-			fmt.Printf("Duplicate rule: %s\n", host)
+			fmt.Printf("Duplicate rule on %s: %s\n", t.Name, host)
 		}
 
-		return
+		return errDuplicateRule
 	}
 
-	now := time.Now()
-
 	// Compose a new rule
-	rule.AclRuleDescription = fmt.Sprintf("%d, Added by tnsrids", now.Unix())
-	rule.Sequence = getNextSeqNum()
+	rule.AclRuleDescription = fmt.Sprintf("%d, Added by tnsrids", created)
+	if len(comment) > 0 {
+		rule.AclRuleDescription += " " + comment
+	}
+
+	if expires > 0 {
+		rule.AclRuleDescription += fmt.Sprintf(", expires %d", expires)
+	}
+
+	rule.Sequence = t.cache.nextSeqNum()
 	rule.Action = "deny"
-	rule.Version = "ipv4"
-	
+	rule.Version = ipVersion(host)
+
 	//Source rule or destination?
 	if src {
 		rule.SrcIPPrefix = host
@@ -141,78 +199,149 @@ func addRule(host string, src bool) {
 	b, err := json.Marshal(rule)
 	if err != nil {
 		log.Printf("Error: %v", err)
-		return
+		return err
 	}
 
 	// Compose the JSON formatting
 	cmd := "{\"netgate-acl:acl-rule\":" + string(b) + "}"
 
 	if verbose {
-		fmt.Printf("Adding rule for host: %s\n", host)
+		fmt.Printf("Adding rule for host: %s on %s\n", host, t.Name)
 	}
 
-	log.Printf("INFO: Adding block rule for \"%s\"", host)
+	log.Printf("INFO: Adding block rule for \"%s\" on %s", host, t.Name)
 
 	// Add the new rule to TNSR via RESTCONF
-	_, err = rest("PUT", fmt.Sprintf("%s%s%s%d", tnsrhost, ACL_WriteRule, "/acl-rule=", getNextSeqNum()), cmd)
+	_, err = t.rest(ctx, "PUT", fmt.Sprintf("%s%s%d", fmt.Sprintf(ACL_WriteRule, t.ACL), "/acl-rule=", rule.Sequence), cmd)
 	if err != nil {
-		log.Printf("Error: %v", err)
-	} else {
-		// Add the new rule to the cached rule list
-		aclcache.AclRule = append(aclcache.AclRule, rule)
+		log.Printf("Error: %s: %v", t.Name, err)
+		return err
+	}
+
+	// Add the new rule to the cached rule list
+	t.cache.AclRule = append(t.cache.AclRule, rule)
+	t.noteCache(t.lastupdate)
+	return nil
+}
+
+// Return the TNSR ip-version for an address or prefix
+func ipVersion(host string) string {
+	if strings.Contains(host, ":") {
+		return "ipv6"
+	}
+
+	return "ipv4"
+}
+
+// Make an HTTP REST call to the target
+// Requires the operator (PUT, POST, GET, DELETE etc), the path of the resource and an optional payload
+// Connection errors and 5xx responses are retried with exponential backoff unless the circuit breaker is open
+func (t *Target) rest(ctx context.Context, oper string, path string, payload string) ([]byte, error) {
+	var err error
+	var contents []byte
+
+	url := t.Host + path
+
+	delay := restBackoff
+
+	for attempt := 0; attempt <= restRetries; attempt++ {
+		if attempt > 0 {
+			if verbose {
+				fmt.Printf("Retrying %s %s in %v\n", oper, url, delay)
+			}
+
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, &RESTError{Err: ctx.Err()}
+			}
+
+			delay = nextBackoff(delay)
+		}
+
+		if !t.breaker.allow() {
+			return nil, errCircuitOpen
+		}
+
+		contents, err = t.restOnce(ctx, oper, url, payload)
+
+		// A call abandoned by the caller says nothing about the target
+		if err != nil && ctx.Err() != nil {
+			t.breaker.release()
+			return nil, &RESTError{Err: ctx.Err()}
+		}
+
+		t.breaker.record(err)
+
+		if err == nil || !retryable(err) {
+			return contents, err
+		}
 	}
+
+	return nil, err
 }
 
-// Make an HTTP REST call
-// Requires the operator (PUT, POST, GET, DELETE etc), the complete URL (including the protocol) and an optional payload
-func rest(oper string, url string, payload string) ([]byte, error) {
+// Make a single HTTP REST call using the target's client
+func (t *Target) restOnce(ctx context.Context, oper string, url string, payload string) ([]byte, error) {
 	var err error
 	var req *http.Request
-	var client *http.Client
 	var resp *http.Response
 
 	if len(payload) == 0 {
-		req, err = http.NewRequest(oper, url, nil)
+		req, err = http.NewRequestWithContext(ctx, oper, url, nil)
 	} else {
 		var jsonStr = []byte(payload)
 
-		req, err = http.NewRequest(oper, url, bytes.NewBuffer(jsonStr))
+		req, err = http.NewRequestWithContext(ctx, oper, url, bytes.NewBuffer(jsonStr))
+	}
+
+	if err != nil {
+		return nil, err
 	}
 
 	// This content-type is required for TNSR > 19-12 and specifically to use the HTTP PATCH mthod
 	req.Header.Set("Content-Type", "application/yang-data+json")
+	t.setAuth(req)
 
-	if useTLS {
-		transport := &http.Transport{TLSClientConfig: tlsConfig}
-		client = &http.Client{Transport: transport}
-	} else {
-		client = &http.Client{}
-	}
-
-	resp, err = client.Do(req)
+	start := time.Now()
+	resp, err = t.restClient().Do(req)
 	if err != nil {
-		fmt.Printf("%v", err)
-		return nil, err
+		observeREST(oper, 0, start)
+		if verbose {
+			fmt.Printf("%v\n", err)
+		}
+
+		return nil, &RESTError{Err: err}
 	}
 
-	defer resp.Body.Close()
-	contents, _ := ioutil.ReadAll(resp.Body)
+	observeREST(oper, resp.StatusCode, start)
 
-	//	fmt.Println("response Status:", resp.Status)
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &RESTError{Err: err}
+	}
 
 	// 204 code is valid if no response is expected. Currently 404 is returned if the configuration item is currently empty
 	// which is not really an error, but sionce the body contains an error message, 204 is not really appropriate.
 	if resp.StatusCode != 200 && resp.StatusCode != 204 && !(resp.StatusCode == 404 && extractErrorMsg(contents) != "Instance does not exist") {
-		return nil, errors.New("RESTCONF operation failed (" + string(resp.Status) + ")")
+		return nil, &RESTError{Status: resp.StatusCode, Err: errors.New("RESTCONF operation failed (" + string(resp.Status) + ")")}
 	}
 
+	// Only a successful call shows that the target is healthy
+	atomic.StoreInt64(&t.lastREST, time.Now().Unix())
 	return contents, nil
 }
 
-// Returns true if a rule exists for the specified host in the local cache
+// Returns true if a rule exists for the specified host in the local cache of the first target
 // Called from functions that have updated the cache already
 func ruleExists(host string) bool {
-	for _, v := range aclcache.AclRule {
+	return aclcache.exists(host)
+}
+
+// Returns true if a rule exists for the specified host in the rule list
+func (rl *ACLRuleList) exists(host string) bool {
+	for _, v := range rl.AclRule {
 		if host == v.DstIPPrefix || host == v.SrcIPPrefix {
 			return true
 		}
@@ -221,16 +350,75 @@ func ruleExists(host string) bool {
 	return false
 }
 
-// Find the lowest unused sequence number in the cached rule list
-// This may be a gap in the sequece from a previously deleted rule, ot it may be the next highest number
+// Return the prefix blocked by the rule with the specified sequence number, or "" if there is none
+func (rl *ACLRuleList) prefix(seq uint64) string {
+	for _, v := range rl.AclRule {
+		if v.Sequence == seq {
+			if len(v.SrcIPPrefix) > 0 {
+				return v.SrcIPPrefix
+			}
+
+			return v.DstIPPrefix
+		}
+	}
+
+	return ""
+}
+
+// Return the sequence number of the rule that blocks the specified prefix, or 0 if there is none
+func (rl *ACLRuleList) sequence(prefix string) uint64 {
+	for _, v := range rl.AclRule {
+		if prefix == v.DstIPPrefix || prefix == v.SrcIPPrefix {
+			return v.Sequence
+		}
+	}
+
+	return 0
+}
+
+// Extract the creation time and optional expiry time from a rule description
+// Descriptions look like "<created>, Added by tnsrids" or "<created>, Added by tnsrids ..., expires <time>"
+func ruleTimes(descr string) (uint64, uint64, error) {
+	var expires uint64
+
+	s := strings.Split(descr, ",")
+	if len(s) < 2 {
+		return 0, 0, errors.New("No timestamp in rule description")
+	}
+
+	created, err := strconv.ParseUint(strings.TrimSpace(s[0]), 10, 64)
+	if err != nil || created == 0 {
+		return 0, 0, errors.New("Invalid timestamp in rule description")
+	}
+
+	for _, f := range s[1:] {
+		f = strings.TrimSpace(f)
+		if strings.HasPrefix(f, "expires ") {
+			expires, err = strconv.ParseUint(strings.TrimPrefix(f, "expires "), 10, 64)
+			if err != nil {
+				return created, 0, errors.New("Invalid expiry time in rule description")
+			}
+		}
+	}
+
+	return created, expires, nil
+}
+
+// Find the lowest unused sequence number in the cached rule list of the first target
 func getNextSeqNum() uint64 {
+	return aclcache.nextSeqNum()
+}
+
+// Find the lowest unused sequence number in the rule list
+// This may be a gap in the sequece from a previously deleted rule, ot it may be the next highest number
+func (rl *ACLRuleList) nextSeqNum() uint64 {
 	var idx uint64
-	var numRules int64 = int64(len(aclcache.AclRule))
+	var numRules int64 = int64(len(rl.AclRule))
 	var ruleCnt int64 = 0
 	var max uint64 = 0
 
 	// Find the highest sequence number in use
-	for _, v := range aclcache.AclRule {
+	for _, v := range rl.AclRule {
 		if v.Sequence > max && v.Action == "deny" {
 			max = v.Sequence
 		}
@@ -240,7 +428,7 @@ func getNextSeqNum() uint64 {
 	for idx = 1; idx < max; idx++ {
 		ruleCnt = 0
 		// See if there is a rule that uses it as a sequence number
-		for _, v := range aclcache.AclRule {
+		for _, v := range rl.AclRule {
 			ruleCnt++
 			if idx == v.Sequence {
 				break
@@ -258,12 +446,12 @@ func getNextSeqNum() uint64 {
 	return max + 1
 }
 
-// Delete the rule with the specified sequece number
-func deleteRule(seq uint64) error {
+// Delete the rule with the specified sequece number from the target
+func (t *Target) deleteRule(ctx context.Context, seq uint64) error {
 
-	var url string = fmt.Sprintf("%s%s%d", tnsrhost, ACL_Delete, seq)
+	var path string = fmt.Sprintf("%s%d", fmt.Sprintf(ACL_Delete, t.ACL), seq)
 
-	_, err := rest("DELETE", url, "")
+	_, err := t.rest(ctx, "DELETE", path, "")
 
 	if err != nil {
 		return (err)
@@ -272,110 +460,179 @@ func deleteRule(seq uint64) error {
 	return nil
 }
 
-// Clean out any rules that have a timestamp older than MAXAGEMINS minutes, no timestamp at all
-// Ignore the defalut permit rule (which has a seq # > maxSeqNum)
+// Clean out any rules that have a timestamp older than MAXAGEMINS minutes, no timestamp at all, from every target
+// A target that cannot be reached is skipped, and the others are still reaped
+// The standby only refreshes its cache, so that it is up to date if it takes over
 func reapACLs() error {
-	deletedSome := false
+	var errs []string
 
-	if verbose {
-		fmt.Println("Cleaning out the old rules")
-	}
+	ctx := context.Background()
 
 	// Lock the mutex so that it is not possible to write new rule while reaping old ones
 	tnsrMutex.Lock()
 	defer tnsrMutex.Unlock()
 
-	var i uint64
-	var err error
+	if !isLeader() {
+		return getSnortBlockACL(ctx, false)
+	}
+
+	if verbose {
+		fmt.Println("Cleaning out the old rules")
+	}
+
+	for _, t := range targets {
+		err := t.reap(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", t.Name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// Clean out the old rules from the target's ACL
+// Ignore the defalut permit rule (which has a seq # > maxSeqNum). Must be called with tnsrMutex held
+func (t *Target) reap(ctx context.Context) error {
+	deletedSome := false
 
-	err = getSnortBlockACL(false)
+	err := t.getBlockACL(ctx, false)
 	if err != nil {
-		return errors.New("Unable to read snortblock rules from TNSR\n")
+		return fmt.Errorf("Unable to read %s rules from TNSR", t.ACL)
 	}
 
 	now := time.Now()
 	epoch := uint64(now.Unix())
-	var zapit bool
 
-	for _, v := range aclcache.AclRule {
+	for _, v := range t.cache.AclRule {
 		// Leave the default permit rule alone
 		if v.Sequence > maxSeqNum {
 			continue
 		}
 
-		zapit = false
-		if !strings.Contains(v.AclRuleDescription, ",") {
+		created, expires, err := ruleTimes(v.AclRuleDescription)
+		if err != nil {
 			log.Printf("INFO: Unable to read timestamp from description. Deleting rule")
-			zapit = true
-		} else {
-			s := strings.Split(v.AclRuleDescription, ",")
-
-			i, err = strconv.ParseUint(s[0], 10, 64)
+		}
 
-			if err != nil || i == 0 {
-				log.Printf("INFO: Unable to read timestamp from description. Deleting rule")
-				zapit = true
-			}
+		// Rules added with an explicit lifetime carry their own expiry time. The others expire after maxruleage,
+		// or never if it is 0
+		if expires == 0 && maxruleage > 0 {
+			expires = created + maxruleage
 		}
 
-		if zapit || (i+maxruleage) < epoch {
+		if err != nil || (expires > 0 && expires < epoch) {
 			if verbose {
-				fmt.Printf("Deleting rule with sequence %v\n", v.Sequence)
+				fmt.Printf("Deleting rule with sequence %v from %s\n", v.Sequence, t.Name)
+			}
+
+			log.Printf("INFO: Reaping rule with sequence %v from %s\n", v.Sequence, t.Name)
+			if t.deleteRule(ctx, v.Sequence) == nil {
+				count(&stats.RulesReaped)
 			}
 
-			log.Printf("INFO: Reaping rule with sequence %v\n", v.Sequence)
-			deleteRule(v.Sequence)
 			deletedSome = true
 		}
 	}
 
 	// Re-read the ACL so that the cache is up to date
 	if deletedSome {
-		err = getSnortBlockACL(true)
+		err = t.getBlockACL(ctx, true)
 		if err != nil {
-			return errors.New("Unable to re-read snortblock rues from TNSR\n")
+			return fmt.Errorf("Unable to re-read %s rules from TNSR", t.ACL)
 		}
 	}
 
 	return nil
 }
 
-// Set up the TLS configuration from the provided ca, certificate and key
-func TLSSetup(ca string, certificate string, key string) error {
+// Delete every rule added by tnsrids from every target, leaving the default permit rule and any rules added by
+// other means. Used on exit in fail-open mode so that nothing stays blocked while tnsrids is not running to reap
+// the rules
+func removeManagedRules() error {
+	var errs []string
 
-	if len(ca) == 0 || len(certificate) == 0 || len(key) == 0 {
-		return nil
+	ctx := context.Background()
+
+	tnsrMutex.Lock()
+	defer tnsrMutex.Unlock()
+
+	for _, t := range targets {
+		err := t.removeManaged(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", t.Name, err))
+		}
 	}
 
-	if verbose {
-		fmt.Println("Attempting TLS initialization")
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
 	}
 
-	// Load client cert
-	cert, err := tls.LoadX509KeyPair(certificate, key)
+	return nil
+}
+
+// Delete every rule added by tnsrids from the target. Must be called with tnsrMutex held
+func (t *Target) removeManaged(ctx context.Context) error {
+	err := t.getBlockACL(ctx, true)
 	if err != nil {
 		return err
 	}
 
-	// Load CA cert
-	caCert, err := ioutil.ReadFile(ca)
-	if err != nil {
-		return err
+	now := time.Now().Unix()
+	removed := 0
+
+	for idx, v := range t.cache.AclRule {
+		if !newRuleInfo(idx, v, now).Managed {
+			continue
+		}
+
+		err = t.deleteRule(ctx, v.Sequence)
+		if err != nil {
+			log.Printf("ERROR: Unable to remove rule with sequence %d from %s: %v", v.Sequence, t.Name, err)
+			continue
+		}
+
+		removed++
 	}
 
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
+	log.Printf("INFO: Fail-open: removed %d block rules from %s", removed, t.Name)
+	return t.getBlockACL(ctx, true)
+}
+
+// Load the ca, certificate and key and build a TLS configuration from them
+// If ca is empty the system CAs are used. If certificate or key is empty no client certificate is presented
+func loadTLSConfig(ca string, certificate string, key string) (*tls.Config, error) {
+	cfg := &tls.Config{}
+
+	// Load client cert
+	if len(certificate) > 0 && len(key) > 0 {
+		cert, err := tls.LoadX509KeyPair(certificate, key)
+		if err != nil {
+			return nil, err
+		}
 
-	// Setup HTTPS client
-	tlsConfig = &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      caCertPool,
+		cfg.Certificates = []tls.Certificate{cert}
 	}
 
-	tlsConfig.BuildNameToCertificate()
-	useTLS = true
+	// Load CA cert
+	if len(ca) > 0 {
+		caCert, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
 
-	return nil
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("No certificates found in %s", ca)
+		}
+
+		cfg.RootCAs = caCertPool
+	}
+
+	return cfg, nil
 }
 
 type IETF_RESTCONF_ERRORS struct {
@@ -0,0 +1,254 @@
+// sensors.go restricts the alert listener to the IDS sensors that are allowed to send to it, and identifies the
+// sensor each alert came from. Without an allowlist any sender is accepted and identified by its address
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const localSensor = "local"           // Identity of the alerts read from files
+const deniedLogInterval = time.Minute // Alerts from a denied sender are logged at most this often
+const maxDeniedLog = 1000             // Limit on the number of denied senders remembered
+
+// A Sensor is an IDS that is permitted to send alerts
+type Sensor struct {
+	Name string // Empty for the addresses in the allow option. Those sensors are identified by their address
+	nets []*net.IPNet
+	key  []byte // Key for signed alerts. nil = the sensor does not sign its alerts
+	rate int    // New blocks per minute for the sensor's alerts. -1 = use the sensorrate option
+}
+
+// The permitted sensors, in configuration order. nil = any sender is accepted
+// The slice is replaced (not modified) on reload
+var sensors []*Sensor
+var sensorMutex sync.Mutex
+
+// When each denied sender was last logged
+var deniedLogged = make(map[string]time.Time)
+
+// Replace the sensors
+func setSensors(list []*Sensor) {
+	sensorMutex.Lock()
+	defer sensorMutex.Unlock()
+
+	sensors = list
+}
+
+// Build the list of sensors from the allow option and the "sensors" section of a YAML config file. Each sensor in
+// the section has a name and one or more addresses or prefixes, a file holding the key it signs its alerts with, or
+// both
+func buildSensors(allow string, section *yaml.Node) ([]*Sensor, error) {
+	var list []*Sensor
+	var configs []map[string]yaml.Node
+
+	nets, err := parseCIDRList(allow)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid allow: %v", err)
+	}
+
+	if len(nets) > 0 {
+		list = append(list, &Sensor{nets: nets, rate: -1})
+	}
+
+	if section == nil {
+		return list, nil
+	}
+
+	err = section.Decode(&configs)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid sensors section (line %d): %v", section.Line, err)
+	}
+
+	names := make(map[string]bool)
+
+	for idx, sc := range configs {
+		s := &Sensor{rate: -1}
+
+		if node, ok := sc["name"]; ok {
+			s.Name = node.Value
+		}
+
+		if len(s.Name) == 0 || strings.ContainsAny(s.Name, " \t,()") {
+			return nil, fmt.Errorf("Sensor %d: invalid name \"%s\"", idx+1, s.Name)
+		}
+
+		if names[s.Name] || s.Name == localSensor {
+			return nil, fmt.Errorf("Duplicate sensor name \"%s\"", s.Name)
+		}
+
+		names[s.Name] = true
+
+		for k, node := range sc {
+			switch strings.ToLower(k) {
+			case "name":
+			case "addr":
+				s.nets, err = parseCIDRList(nodeList(node))
+				if err != nil {
+					return nil, fmt.Errorf("Sensor %s: %v", s.Name, err)
+				}
+			case "rate":
+				s.rate, err = strconv.Atoi(node.Value)
+				if err != nil || s.rate < 0 {
+					return nil, fmt.Errorf("Sensor %s: invalid rate \"%s\"", s.Name, node.Value)
+				}
+			case "keyfile":
+				s.key, err = loadSensorKey(node.Value)
+				if err != nil {
+					return nil, fmt.Errorf("Sensor %s: %v", s.Name, err)
+				}
+			default:
+				return nil, fmt.Errorf("Sensor %s: unknown option \"%s\"", s.Name, k)
+			}
+		}
+
+		if len(s.nets) == 0 && s.key == nil {
+			return nil, fmt.Errorf("Sensor %s: no addr or keyfile", s.Name)
+		}
+
+		list = append(list, s)
+	}
+
+	return list, nil
+}
+
+// Return a scalar node's value, or the values of a list of scalars separated by commas
+func nodeList(node yaml.Node) string {
+	if node.Kind != yaml.SequenceNode {
+		return node.Value
+	}
+
+	var vals []string
+	for _, item := range node.Content {
+		vals = append(vals, item.Value)
+	}
+
+	return strings.Join(vals, ",")
+}
+
+// Return the identity of the sensor at addr. ok is false if the sender is not permitted. The first sensor whose
+// addresses include addr is used
+func identifySensor(addr net.IP) (name string, ok bool) {
+	sensorMutex.Lock()
+	defer sensorMutex.Unlock()
+
+	if sensors == nil {
+		return addr.String(), true
+	}
+
+	for _, s := range sensors {
+		if s.contains(addr) {
+			if len(s.Name) == 0 {
+				return addr.String(), true
+			}
+
+			return s.Name, true
+		}
+	}
+
+	return "", false
+}
+
+// Returns true if addr is one of the sensor's addresses
+func (s *Sensor) contains(addr net.IP) bool {
+	for _, n := range s.nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return the rate limit set for the named sensor. ok is false if it has none
+func sensorRate(name string) (rate int, ok bool) {
+	sensorMutex.Lock()
+	defer sensorMutex.Unlock()
+
+	s := findSensor(name)
+	if s == nil || s.rate < 0 {
+		return 0, false
+	}
+
+	return s.rate, true
+}
+
+// Returns true if the sensor at addr signs its alerts. The first sensor whose addresses include addr is used, as in
+// identifySensor(). Must be called with sensorMutex held
+func keyedSensor(addr net.IP) bool {
+	for _, s := range sensors {
+		if s.contains(addr) {
+			return s.key != nil
+		}
+	}
+
+	return false
+}
+
+// Returns true if name is the local sensor or one listed in the sensors section, rather than the address of a sender
+func knownSensor(name string) bool {
+	sensorMutex.Lock()
+	defer sensorMutex.Unlock()
+
+	return name == localSensor || findSensor(name) != nil
+}
+
+// Return the sensor with the given name, or nil. Must be called with sensorMutex held
+func findSensor(name string) *Sensor {
+	for _, s := range sensors {
+		if len(s.Name) > 0 && s.Name == name {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// Count an alert that was dropped because the sender is not permitted or the alert could not be authenticated,
+// logging it unless the sender was logged recently
+func denySender(addr string, err error) {
+	if err == errNotPermitted {
+		count(&stats.AlertsDenied)
+	} else {
+		count(&stats.AlertsUnauthenticated)
+	}
+
+	sensorMutex.Lock()
+	defer sensorMutex.Unlock()
+
+	now := time.Now()
+	if last, ok := deniedLogged[addr]; ok && now.Sub(last) < deniedLogInterval {
+		return
+	}
+
+	if len(deniedLogged) >= maxDeniedLog {
+		deniedLogged = make(map[string]time.Time)
+	}
+
+	deniedLogged[addr] = now
+	log.Printf("ERROR: Dropping alert from %s: %v", addr, err)
+}
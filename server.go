@@ -17,15 +17,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
+	"time"
 )
 
 // startServer is a very simplistic UDP server that listens on the specified port and passes received messages
-// to a parser, without regard for where they came from. In production, it would be better to set up a rx channel
-// for each source
-func startServer(port string) {
+// to the decoder. Messages from senders that are not permitted sensors, or that can not be authenticated, are dropped
+// When ctx is cancelled the listener is closed and startServer waits up to drain for the queued hosts to be processed
+// It does not return while a block is still being added, unless that takes longer than the RESTCONF timeout
+func startServer(ctx context.Context, port string, dec Decoder, drain time.Duration) {
 
 	host := ":" + port
 	proto := "udp"
@@ -43,25 +46,66 @@ func startServer(port string) {
 		return
 	}
 
-	defer listener.Close()
+	health.setListening(true)
+
+	// Stop accepting alerts when asked to shut down. Closing the listener unblocks ReadFrom()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
 
 	// channel acts like a FIFO providing a 4096 string buffer between reading hosts via UDP and updating TNSR via RESTCONF
-	hf := make(chan string, 4096)
+	hf := hostQueue
 
 	// Start the go routine that reads from the channel and processes the syslog messages
-	go processHosts(hf)
+	finished := make(chan struct{})
+	deadline, abandon := context.WithCancel(context.Background())
+	defer abandon()
+	go processHosts(ctx, deadline, hf, finished)
 
 	// Read incoming syslog messages and push them into the FIFO
 	for {
-		message := make([]byte, 4096)
-		length, _, err := listener.ReadFrom(message)
+		message := make([]byte, maxDatagram)
+		length, from, err := listener.ReadFrom(message)
 		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+
 			log.Fatal("Unable to read from UDP listener")
 			return
 		}
 
-		if length > 0 {
-			parseAlerts(string(message[0:length]), hf)
+		if length == 0 {
+			continue
+		}
+
+		addr := from.(*net.UDPAddr).IP
+		sensor, msg, err := authenticate(string(message[0:length]), addr)
+		if err != nil {
+			denySender(addr.String(), err)
+			continue
+		}
+
+		parseAlerts(msg, sensor, dec, hf)
+	}
+
+	health.setListening(false)
+	log.Printf("INFO: Listener stopped. Waiting up to %v for %d queued hosts", drain, queueDepth())
+
+	select {
+	case <-finished:
+	case <-time.After(drain):
+		log.Printf("ERROR: Shutdown deadline reached with %d hosts still queued", queueDepth())
+		abandon()
+
+		// Wait for the worker to stop, so that no rule is added after the caller starts tearing down (removing
+		// the rules in fail-open mode, for one). Abandoned RESTCONF calls return at once, but the worker may be
+		// waiting for another call to finish first
+		select {
+		case <-finished:
+		case <-time.After(restTimeout):
+			log.Printf("ERROR: Block worker did not stop within %v", restTimeout)
 		}
 	}
 }
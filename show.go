@@ -0,0 +1,396 @@
+// show.go formats the rules in the block ACLs for display by the -show command, either as a table for
+// operators or as JSON/CSV for scripts
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Output formats supported by -show
+const (
+	fmtTable = "table"
+	fmtJSON  = "json"
+	fmtCSV   = "csv"
+)
+
+// A RuleInfo is an ACL rule with its description decoded into the values tnsrids stores there
+type RuleInfo struct {
+	Index       int    `json:"index"`
+	Sequence    uint64 `json:"sequence"`
+	Direction   string `json:"direction"` // "src" or "dst"
+	Prefix      string `json:"prefix"`
+	Action      string `json:"action"`
+	Description string `json:"description"`
+	Managed     bool   `json:"managed"`             // Added by tnsrids (as opposed to the default permit or hand-made rules)
+	Created     int64  `json:"created,omitempty"`   // Epoch time the rule was added
+	Expires     int64  `json:"expires,omitempty"`   // Epoch time the rule will be reaped. 0 = never
+	Remaining   int64  `json:"remaining,omitempty"` // Seconds until the rule is reaped
+	Target      string `json:"target,omitempty"`    // Name of the TNSR target the rule is installed on
+}
+
+// Sort keys supported by -sort
+const (
+	sortSeq  = "seq"
+	sortAge  = "age"
+	sortAddr = "addr"
+)
+
+// A RuleFilter selects the rules displayed by -show. Zero values match everything
+type RuleFilter struct {
+	Networks  []*net.IPNet // Rule prefix must overlap one of these networks
+	MinAge    int64        // Rule must be at least this many seconds old
+	MaxAge    int64        // Rule must be no more than this many seconds old
+	Expiring  int64        // Rule must expire within this many seconds
+	Managed   bool         // Only rules added by tnsrids
+	Action    string       // Rule action (deny, permit)
+	SortKey   string       // One of the sortXXX constants
+	timestamp int64        // Time to which ages are relative
+}
+
+// Build a filter from the command line/config options. Ages and times are specified in minutes or as durations
+func newRuleFilter(options map[string]string) (RuleFilter, error) {
+	f := RuleFilter{Action: options["action"], SortKey: options["sort"], Managed: options["managed"] == "yes"}
+
+	if len(options["contains"]) > 0 {
+		list, err := parseCIDRList(options["contains"])
+		if err != nil {
+			return f, err
+		}
+
+		f.Networks = list
+	}
+
+	mins := []struct {
+		name string
+		val  *int64
+	}{
+		{"olderthan", &f.MinAge},
+		{"newerthan", &f.MaxAge},
+		{"expiring", &f.Expiring},
+	}
+
+	for _, m := range mins {
+		if len(options[m.name]) == 0 {
+			continue
+		}
+
+		d, err := parseDuration(options[m.name], time.Minute)
+		if err != nil {
+			return f, fmt.Errorf("Invalid value for %s: %v", m.name, err)
+		}
+
+		*m.val = int64(d.Seconds())
+	}
+
+	switch f.SortKey {
+	case "", sortSeq, sortAge, sortAddr:
+	default:
+		return f, fmt.Errorf("Unknown sort key \"%s\". Use seq, age or addr", f.SortKey)
+	}
+
+	return f, nil
+}
+
+// Returns true if the two networks overlap (one contains the other)
+func overlaps(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// Returns true if the network overlaps any of the filter's networks
+func (f RuleFilter) overlaps(ipnet *net.IPNet) bool {
+	for _, n := range f.Networks {
+		if overlaps(n, ipnet) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if the rule is selected by the filter
+func (f RuleFilter) match(ri RuleInfo) bool {
+	if len(f.Action) > 0 && f.Action != ri.Action {
+		return false
+	}
+
+	if f.Managed && !ri.Managed {
+		return false
+	}
+
+	if len(f.Networks) > 0 {
+		_, ipnet, err := net.ParseCIDR(ri.Prefix)
+		if err != nil || !f.overlaps(ipnet) {
+			return false
+		}
+	}
+
+	// Age filters only make sense for rules with a timestamp
+	if f.MinAge > 0 || f.MaxAge > 0 {
+		if ri.Created == 0 {
+			return false
+		}
+
+		age := f.timestamp - ri.Created
+		if age < f.MinAge || (f.MaxAge > 0 && age > f.MaxAge) {
+			return false
+		}
+	}
+
+	if f.Expiring > 0 && (ri.Expires == 0 || ri.Remaining > f.Expiring) {
+		return false
+	}
+
+	return true
+}
+
+// Return the rules selected by the filter, sorted by the filter's sort key
+func (f RuleFilter) apply(list []RuleInfo) []RuleInfo {
+	selected := make([]RuleInfo, 0, len(list))
+
+	for _, ri := range list {
+		if f.match(ri) {
+			selected = append(selected, ri)
+		}
+	}
+
+	switch f.SortKey {
+	case sortSeq:
+		sort.SliceStable(selected, func(i, j int) bool { return selected[i].Sequence < selected[j].Sequence })
+	case sortAge:
+		// Oldest first. Rules with no timestamp are listed last
+		sort.SliceStable(selected, func(i, j int) bool {
+			if selected[i].Created == 0 || selected[j].Created == 0 {
+				return selected[j].Created == 0 && selected[i].Created != 0
+			}
+
+			return selected[i].Created < selected[j].Created
+		})
+	case sortAddr:
+		sort.SliceStable(selected, func(i, j int) bool { return addrLess(selected[i].Prefix, selected[j].Prefix) })
+	}
+
+	return selected
+}
+
+// Compare two prefixes numerically by address, then by prefix length
+func addrLess(a string, b string) bool {
+	ipa, neta, erra := net.ParseCIDR(a)
+	ipb, netb, errb := net.ParseCIDR(b)
+	if erra != nil || errb != nil {
+		return a < b
+	}
+
+	if c := bytes.Compare(ipa.To16(), ipb.To16()); c != 0 {
+		return c < 0
+	}
+
+	lena, _ := neta.Mask.Size()
+	lenb, _ := netb.Mask.Size()
+	return lena < lenb
+}
+
+// Filter and sort the rules of each target separately, so that they stay grouped by target
+func (f RuleFilter) applyByTarget(list []RuleInfo) []RuleInfo {
+	selected := make([]RuleInfo, 0, len(list))
+
+	start := 0
+	for idx := 1; idx <= len(list); idx++ {
+		if idx == len(list) || list[idx].Target != list[start].Target {
+			selected = append(selected, f.apply(list[start:idx])...)
+			start = idx
+		}
+	}
+
+	return selected
+}
+
+// Decode a rule. now is the epoch time used to calculate the remaining lifetime
+func newRuleInfo(idx int, r AAclRule, now int64) RuleInfo {
+	ri := RuleInfo{Index: idx, Sequence: r.Sequence, Action: r.Action, Description: r.AclRuleDescription}
+
+	if len(r.DstIPPrefix) == 0 {
+		ri.Direction = "src"
+		ri.Prefix = r.SrcIPPrefix
+	} else {
+		ri.Direction = "dst"
+		ri.Prefix = r.DstIPPrefix
+	}
+
+	created, expires, err := ruleTimes(r.AclRuleDescription)
+	if err != nil || r.Sequence > maxSeqNum || !strings.Contains(r.AclRuleDescription, "Added by tnsrids") {
+		return ri
+	}
+
+	ri.Managed = true
+	ri.Created = int64(created)
+
+	if expires == 0 && maxruleage > 0 {
+		expires = created + maxruleage
+	}
+
+	if expires > 0 {
+		ri.Expires = int64(expires)
+		ri.Remaining = ri.Expires - now
+		if ri.Remaining < 0 {
+			ri.Remaining = 0
+		}
+	}
+
+	return ri
+}
+
+// Decode every rule in the list
+func (c ACLRuleList) ruleInfo() []RuleInfo {
+	now := time.Now().Unix()
+	list := make([]RuleInfo, 0, len(c.AclRule))
+
+	for idx, r := range c.AclRule {
+		list = append(list, newRuleInfo(idx, r, now))
+	}
+
+	return list
+}
+
+// Decode the cached rules of every target. Must be called with tnsrMutex held
+func targetRuleInfo() []RuleInfo {
+	var list []RuleInfo
+
+	for _, t := range targets {
+		for _, ri := range t.cache.ruleInfo() {
+			ri.Target = t.Name
+			list = append(list, ri)
+		}
+	}
+
+	return list
+}
+
+// Format an epoch time for display. 0 is displayed as "-"
+func fmtTime(epoch int64) string {
+	if epoch == 0 {
+		return "-"
+	}
+
+	return time.Unix(epoch, 0).Format(time.RFC3339)
+}
+
+// Print a pretty list of the rules, with a heading for each target
+func printTable(w io.Writer, list []RuleInfo) error {
+	var dstsrc string
+
+	for idx, ri := range list {
+		if idx == 0 || ri.Target != list[idx-1].Target {
+			heading := fmt.Sprintf("Currently installed rules on %s", ri.Target)
+			fmt.Fprintf(w, "\n%s\n%s\n", heading, strings.Repeat("-", len(heading)))
+		}
+
+		if ri.Direction == "src" {
+			dstsrc = "Src IP"
+		} else {
+			dstsrc = "Dst IP"
+		}
+
+		remaining := "-"
+		if ri.Expires > 0 {
+			remaining = (time.Duration(ri.Remaining) * time.Second).String()
+		}
+
+		fmt.Fprintf(w, "%3d Sequence #: %10d, %s %18s, Action: %7s, Expires: %25s (%10s), Description: %s\n",
+			ri.Index, ri.Sequence, dstsrc, ri.Prefix, ri.Action, fmtTime(ri.Expires), remaining, ri.Description)
+	}
+
+	return nil
+}
+
+// Print the rules as a JSON array
+func printJSON(w io.Writer, list []RuleInfo) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(list)
+}
+
+// Print the rules as CSV with a header row. Times are RFC3339, the remaining lifetime is in seconds
+func printCSV(w io.Writer, list []RuleInfo) error {
+	cw := csv.NewWriter(w)
+
+	cw.Write([]string{"index", "sequence", "direction", "prefix", "action", "managed", "created", "expires", "remaining", "description", "target"})
+
+	for _, ri := range list {
+		created, expires := "", ""
+		if ri.Created > 0 {
+			created = fmtTime(ri.Created)
+		}
+
+		if ri.Expires > 0 {
+			expires = fmtTime(ri.Expires)
+		}
+
+		cw.Write([]string{strconv.Itoa(ri.Index), strconv.FormatUint(ri.Sequence, 10), ri.Direction, ri.Prefix,
+			ri.Action, strconv.FormatBool(ri.Managed), created, expires, strconv.FormatInt(ri.Remaining, 10), ri.Description, ri.Target})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// Print the rules selected by the filter in the requested format
+func listACLs(list []RuleInfo, format string, filter RuleFilter) error {
+	log.Printf("INFO: Listing ACL block rules")
+
+	filter.timestamp = time.Now().Unix()
+	list = filter.applyByTarget(list)
+
+	switch format {
+	case fmtTable:
+		return printTable(os.Stdout, list)
+	case fmtJSON:
+		return printJSON(os.Stdout, list)
+	case fmtCSV:
+		return printCSV(os.Stdout, list)
+	}
+
+	return fmt.Errorf("Unknown output format \"%s\". Use table, json or csv", format)
+}
+
+// Retrieve the rules from every target and print them to the console
+func showACLs(format string, filter RuleFilter) error {
+	tnsrMutex.Lock()
+	err := getSnortBlockACL(context.Background(), false)
+	list := targetRuleInfo()
+	tnsrMutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return listACLs(list, format, filter)
+}
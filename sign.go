@@ -0,0 +1,246 @@
+// sign.go authenticates alert messages. A sensor that shares a key with tnsrids prefixes each alert with its name,
+// a timestamp, a random nonce and an HMAC-SHA256 of the whole, so forged and replayed alerts can be dropped. The
+// forwarder (tnsrids -forward) runs on the sensor and signs the alerts it reads from stdin
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A signed alert is "TNSRIDS1 <sensor> <epoch time> <nonce> <hmac> <alert>". The HMAC is of the message with the
+// hmac field and the space after it removed
+const sigMagic = "TNSRIDS1"
+const maxDatagram = 4096    // Size of the largest alert message the listener reads
+const minKeyLen = 16        // Shortest key accepted
+const nonceLen = 8          // Bytes of randomness in each nonce
+const dfltSignWindow = "30" // Seconds by which the timestamp of a signed alert may differ from our clock
+
+var errUnsigned = errors.New("Alert is not signed")
+var errBadSignature = errors.New("Invalid alert signature")
+var errReplayed = errors.New("Replayed alert")
+var errNotPermitted = errors.New("Not a permitted sensor")
+
+// Signing settings, protected by sensorMutex
+var requireSigned bool            // Drop alerts that are not signed
+var signWindow = 30 * time.Second // Maximum clock difference for signed alerts
+
+// The sensor/nonce of recent signed alerts, in two generations. The current generation becomes the previous one
+// every 2*signWindow, so each nonce is remembered for at least that long, which covers the window in which its
+// timestamp is accepted, without scanning the nonces on every alert. Also protected by sensorMutex
+var nonces = make(map[string]bool)
+var oldNonces = make(map[string]bool)
+var noncesRotated time.Time
+
+// Set whether alerts must be signed and the permitted clock difference
+func setSigning(required bool, window time.Duration) {
+	sensorMutex.Lock()
+	defer sensorMutex.Unlock()
+
+	requireSigned = required
+	signWindow = window
+}
+
+// Read a sensor key from a file. The key is the first line, which must be at least minKeyLen characters
+func loadSensorKey(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	// The file holds a secret, so it should not be readable by anyone else
+	info, err := file.Stat()
+	if err == nil && info.Mode().Perm()&0077 != 0 {
+		log.Printf("WARNING: Key file %s is accessible by other users", path)
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Scan()
+
+	key := strings.TrimSpace(scanner.Text())
+	if len(key) < minKeyLen {
+		return nil, fmt.Errorf("Key in %s is shorter than %d characters", path, minKeyLen)
+	}
+
+	return []byte(key), nil
+}
+
+// Return the HMAC of the signed fields and the alert
+func alertMAC(key []byte, header string, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, header)
+	io.WriteString(mac, payload)
+	return mac.Sum(nil)
+}
+
+// Sign an alert with the sensor's key
+func signAlert(key []byte, sensor string, payload string, now time.Time) (string, error) {
+	nonce := make([]byte, nonceLen)
+
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	header := fmt.Sprintf("%s %s %d %s ", sigMagic, sensor, now.Unix(), hex.EncodeToString(nonce))
+	return header + hex.EncodeToString(alertMAC(key, header, payload)) + " " + payload, nil
+}
+
+// Check the signature, timestamp and nonce of a signed alert from addr. Returns the sensor name and the alert
+func verifyAlert(msg string, addr net.IP, now time.Time) (string, string, error) {
+	f := strings.SplitN(msg, " ", 6)
+	if len(f) != 6 || f[0] != sigMagic {
+		return "", "", errUnsigned
+	}
+
+	name, stamp, nonce, sig, payload := f[1], f[2], f[3], f[4], f[5]
+
+	sensorMutex.Lock()
+	defer sensorMutex.Unlock()
+
+	s := findSensor(name)
+	if s == nil || s.key == nil {
+		return "", "", fmt.Errorf("Unknown sensor \"%s\" or no key configured", name)
+	}
+
+	if len(s.nets) > 0 && !s.contains(addr) {
+		return "", "", fmt.Errorf("Sensor \"%s\" is not permitted to send from this address", name)
+	}
+
+	mac, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, alertMAC(s.key, strings.Join(f[:4], " ")+" ", payload)) {
+		return "", "", errBadSignature
+	}
+
+	ts, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return "", "", errBadSignature
+	}
+
+	if d := now.Sub(time.Unix(ts, 0)); d > signWindow || d < -signWindow {
+		return "", "", fmt.Errorf("Alert timestamp is %v from our clock", d.Round(time.Second))
+	}
+
+	// Forget the nonces that are too old to be accepted again
+	if age := now.Sub(noncesRotated); age >= 2*signWindow {
+		oldNonces = nonces
+		if age >= 4*signWindow {
+			oldNonces = make(map[string]bool)
+		}
+
+		nonces = make(map[string]bool)
+		noncesRotated = now
+	}
+
+	key := name + "/" + nonce
+	if nonces[key] || oldNonces[key] {
+		return "", "", errReplayed
+	}
+
+	nonces[key] = true
+	return name, payload, nil
+}
+
+// Identify the sensor that sent an alert and return the alert without any signature. Signed alerts are always
+// verified. Unsigned alerts are accepted from permitted addresses unless signing is required or the address belongs
+// to a sensor that has a key, since anyone could forge an unsigned alert from that address
+func authenticate(msg string, addr net.IP) (string, string, error) {
+	if strings.HasPrefix(msg, sigMagic+" ") {
+		return verifyAlert(msg, addr, time.Now())
+	}
+
+	sensorMutex.Lock()
+	required := requireSigned || keyedSensor(addr)
+	sensorMutex.Unlock()
+
+	if required {
+		return "", "", errUnsigned
+	}
+
+	sensor, ok := identifySensor(addr)
+	if !ok {
+		return "", "", errNotPermitted
+	}
+
+	return sensor, msg, nil
+}
+
+// Sign each line read from in and send it to the tnsrids listener at addr. Runs until in is closed
+func forwardAlerts(in io.Reader, addr string, sensor string, keyfile string) error {
+	if len(sensor) == 0 || strings.ContainsAny(sensor, " \t,()") {
+		return fmt.Errorf("Invalid sensor name \"%s\"", sensor)
+	}
+
+	key, err := loadSensorKey(keyfile)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	log.Printf("INFO: Forwarding signed alerts from sensor %s to %s", sensor, addr)
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, followReadSize), maxLineLen)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		msg, err := signAlert(key, sensor, line, time.Now())
+		if err != nil {
+			return err
+		}
+
+		if len(msg) > maxDatagram {
+			log.Printf("ERROR: Alert too long to forward (%d bytes): %.80s", len(msg), line)
+			continue
+		}
+
+		// The listener may not be running yet. UDP gives no other indication, so just log it
+		_, err = conn.Write([]byte(msg))
+		if err != nil {
+			log.Printf("ERROR: Unable to forward alert: %v", err)
+		}
+	}
+
+	return scanner.Err()
+}
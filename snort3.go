@@ -0,0 +1,165 @@
+// snort3.go decodes alerts written by the Snort 3 alert_json logger, and the fields of Snort 2 alert_syslog messages
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The alert_json fields that tnsrids uses. Snort 3 only writes the fields listed in alert_json.fields, so the
+// addresses may be given either on their own (src_addr) or with the port (src_ap)
+type snort3Event struct {
+	SrcAddr  string  `json:"src_addr"`
+	DstAddr  string  `json:"dst_addr"`
+	SrcAP    string  `json:"src_ap"`
+	DstAP    string  `json:"dst_ap"`
+	GID      *uint64 `json:"gid"`
+	SID      *uint64 `json:"sid"`
+	Rule     string  `json:"rule"` // gid:sid:rev
+	Msg      string  `json:"msg"`
+	Priority int     `json:"priority"`
+	Dir      string  `json:"dir"` // C2S, S2C or UNK
+}
+
+// Snort 2 alert_syslog: "[gid:sid:rev] msg [Classification: ...] [Priority: n] {proto} src[:port] -> dst[:port]"
+// alert_fast is the same with "[**]" around the message
+var snortSyslogRE = regexp.MustCompile(`\[(\d+):(\d+):\d+\]\s*(.*?)\s*(?:\[\*\*\]\s*)?(?:\[Classification:[^\]]*\]\s*)?(?:\[Priority:\s*(\d+)\]\s*)?\{(\w+)\}\s*(\S+)\s*->\s*(\S+)`)
+
+// Decode a Snort 3 alert_json event. ok is false if the message is not one
+func parseSnort3JSON(msg string) (Alert, bool) {
+	var ev snort3Event
+
+	start := strings.IndexByte(msg, '{')
+	if start < 0 {
+		return Alert{}, false
+	}
+
+	err := json.Unmarshal([]byte(msg[start:]), &ev)
+	if err != nil {
+		return Alert{}, false
+	}
+
+	a := Alert{Format: fmtSnort3, Src: ev.SrcAddr, Dst: ev.DstAddr, Signature: ev.Msg, Severity: ev.Priority}
+
+	// Snort 3 always writes a port in src_ap and dst_ap, 0 if the protocol has none
+	if len(a.Src) == 0 {
+		a.Src = apAddr(ev.SrcAP, true)
+	}
+
+	if len(a.Dst) == 0 {
+		a.Dst = apAddr(ev.DstAP, true)
+	}
+
+	// Without addresses or a rule this is some other JSON
+	if len(a.Src) == 0 && len(ev.Rule) == 0 && ev.SID == nil {
+		return Alert{}, false
+	}
+
+	if f := strings.Split(ev.Rule, ":"); len(f) == 3 {
+		a.GID, _ = strconv.ParseUint(f[0], 10, 64)
+		a.SID, _ = strconv.ParseUint(f[1], 10, 64)
+	}
+
+	if ev.GID != nil {
+		a.GID = *ev.GID
+	}
+
+	if ev.SID != nil {
+		a.SID = *ev.SID
+	}
+
+	// The client is the attacker, which is the destination of a packet from the server
+	a.Attacker = a.Src
+
+	switch ev.Dir {
+	case "C2S":
+		a.Direction = "to_server"
+	case "S2C":
+		a.Direction = "to_client"
+		a.Attacker = a.Dst
+	}
+
+	return a, true
+}
+
+// Decode a Snort 2 alert_syslog message. ok is false if the message is not one
+func parseSnortSyslog(msg string) (Alert, bool) {
+	m := snortSyslogRE.FindStringSubmatch(msg)
+	if m == nil {
+		return Alert{}, false
+	}
+
+	ported := m[5] == "TCP" || m[5] == "UDP"
+
+	a := Alert{Format: fmtSyslog, Signature: m[3], Src: apAddr(m[6], ported), Dst: apAddr(m[7], ported)}
+	a.GID, _ = strconv.ParseUint(m[1], 10, 64)
+	a.SID, _ = strconv.ParseUint(m[2], 10, 64)
+	a.Severity, _ = strconv.Atoi(m[4])
+	a.Attacker = a.Src
+	return a, true
+}
+
+// Decode a Snort 2 alert_fast line, which is marked by "[**]" but otherwise the same as alert_syslog
+func parseSnortFast(msg string) (Alert, bool) {
+	if !strings.Contains(msg, "[**]") {
+		return Alert{}, false
+	}
+
+	a, ok := parseSnortSyslog(msg)
+	a.Format = fmtFast
+	return a, ok
+}
+
+// Return the address from an "address:port" pair, or "" if there is no unambiguous address. Snort writes IPv6
+// addresses without brackets, so ported says whether there is a port after the last colon. For protocols without
+// ports (ICMP) there is none. An address in brackets or an IPv4 address is split either way
+func apAddr(ap string, ported bool) string {
+	if strings.HasPrefix(ap, "[") || strings.Count(ap, ":") == 1 {
+		host, _, err := net.SplitHostPort(ap)
+		if err != nil || net.ParseIP(host) == nil {
+			return ""
+		}
+
+		return host
+	}
+
+	if ported {
+		idx := strings.LastIndexByte(ap, ':')
+		if idx < 0 {
+			return ""
+		}
+
+		_, err := strconv.ParseUint(ap[idx+1:], 10, 16)
+		if err != nil {
+			return ""
+		}
+
+		ap = ap[:idx]
+	}
+
+	if net.ParseIP(ap) == nil {
+		return ""
+	}
+
+	return ap
+}
@@ -0,0 +1,274 @@
+// spool.go implements a write-ahead spool directory for pending blocks. Each host waiting to be blocked is written to
+// its own file before it is queued, and the file is removed once the block has been handled, so pending blocks
+// survive a restart or a TNSR outage. When the spool is enabled it replaces the in-memory channel as the queue
+// between the listener and processHosts(), so the listener never blocks on a full channel
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Overflow policies applied when the spool is full
+const (
+	dropNew    = "drop-new"    // Discard the new block
+	dropOldest = "drop-oldest" // Discard the oldest pending block to make room
+)
+
+const spoolExt = ".blk"
+
+// A Spool is a directory of pending blocks, one per file, named with an increasing sequence number so that they
+// can be replayed in order
+type Spool struct {
+	dir      string
+	maxSize  int
+	policy   string
+	mutex    sync.Mutex
+	nextID   uint64
+	pending  []uint64      // IDs of the spooled blocks, oldest first
+	notify   chan struct{} // Signalled when a block is added
+	inFlight uint64        // ID of the block being processed, which drop-oldest must not remove
+}
+
+// The spool, or nil if spooling is disabled
+var spool *Spool
+
+// Open (creating if necessary) the spool directory and load any blocks left from a previous run
+func openSpool(dir string, maxSize int, policy string) (*Spool, error) {
+	if policy != dropNew && policy != dropOldest {
+		return nil, fmt.Errorf("Unknown spool overflow policy \"%s\". Use %s or %s", policy, dropNew, dropOldest)
+	}
+
+	if maxSize <= 0 {
+		return nil, errors.New("Spool size must be greater than 0")
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{dir: dir, maxSize: maxSize, policy: policy, nextID: 1, notify: make(chan struct{}, 1)}
+
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), spoolExt) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), spoolExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		s.pending = append(s.pending, id)
+	}
+
+	sort.Slice(s.pending, func(i, j int) bool { return s.pending[i] < s.pending[j] })
+
+	if len(s.pending) > 0 {
+		s.nextID = s.pending[len(s.pending)-1] + 1
+		log.Printf("INFO: Replaying %d pending blocks from spool %s", len(s.pending), dir)
+		s.signal()
+	}
+
+	return s, nil
+}
+
+// Path of the file holding the block with the specified ID
+func (s *Spool) path(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, spoolExt))
+}
+
+// Wake processHosts() if it is waiting
+func (s *Spool) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Write a block to the spool. The file is written under a temporary name then renamed so a crash never leaves
+// a partial entry
+func (s *Spool) push(host string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.pending) >= s.maxSize {
+		if s.policy == dropNew || (len(s.pending) == 1 && s.pending[0] == s.inFlight) {
+			count(&stats.AlertsDropped)
+			return fmt.Errorf("Spool full. Dropping block for \"%s\"", host)
+		}
+
+		// Discard the oldest block that is not currently being processed
+		idx := 0
+		if s.pending[0] == s.inFlight {
+			idx = 1
+		}
+
+		id := s.pending[idx]
+		os.Remove(s.path(id))
+		s.pending = append(s.pending[:idx], s.pending[idx+1:]...)
+		count(&stats.AlertsDropped)
+		log.Printf("INFO: Spool full. Dropped oldest pending block %d", id)
+	}
+
+	id := s.nextID
+	tmp := s.path(id) + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(host + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+
+	f.Close()
+
+	if err == nil {
+		err = os.Rename(tmp, s.path(id))
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	s.nextID++
+	s.pending = append(s.pending, id)
+	s.signal()
+	return nil
+}
+
+// Wait for and return the oldest block in the spool. It remains in the spool until done() is called
+// ok is false if ctx is cancelled while waiting
+func (s *Spool) next(ctx context.Context) (id uint64, host string, ok bool) {
+	for {
+		s.mutex.Lock()
+		for len(s.pending) > 0 {
+			id = s.pending[0]
+			b, err := ioutil.ReadFile(s.path(id))
+			if err == nil {
+				s.inFlight = id
+				s.mutex.Unlock()
+				return id, strings.TrimSpace(string(b)), true
+			}
+
+			// An unreadable entry can never be processed, so discard it
+			log.Printf("ERROR: Discarding unreadable spool entry %d: %v", id, err)
+			os.Remove(s.path(id))
+			s.pending = s.pending[1:]
+		}
+		s.mutex.Unlock()
+
+		select {
+		case <-s.notify:
+		case <-ctx.Done():
+			return 0, "", false
+		}
+	}
+}
+
+// Remove a block from the spool once it has been handled
+func (s *Spool) done(id uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := os.Remove(s.path(id))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("ERROR: Unable to remove spool entry %d: %v", id, err)
+	}
+
+	for idx, v := range s.pending {
+		if v == id {
+			s.pending = append(s.pending[:idx], s.pending[idx+1:]...)
+			break
+		}
+	}
+
+	s.inFlight = 0
+}
+
+// Write data to path atomically, by writing a temporary file in the same directory and renaming it, so that a
+// crash or a reader on another host never sees a partial file
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Number of blocks in the spool
+func (s *Spool) len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.pending)
+}
+
+// Number of hosts waiting to be blocked, from whichever queue is in use
+func queueDepth() int {
+	if spool != nil {
+		return spool.len()
+	}
+
+	return len(hostQueue)
+}
+
+// Maximum number of hosts that can be waiting to be blocked
+func queueCapacity() int {
+	if spool != nil {
+		return spool.maxSize
+	}
+
+	return cap(hostQueue)
+}
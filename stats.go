@@ -0,0 +1,116 @@
+// stats.go keeps running counts of the work done by the daemon and a short history of the alerts received,
+// both of which are made available through the management API
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of alerts remembered for the management API
+const maxRecentAlerts = 100
+
+// Stats are counters updated atomically by the listener, processHosts() and reapACLs()
+type Stats struct {
+	Started               int64  `json:"started"` // Epoch time at which the daemon started
+	AlertsReceived        uint64 `json:"alerts-received"`
+	AlertsParsed          uint64 `json:"alerts-parsed"`
+	AlertsRejected        uint64 `json:"alerts-rejected"`        // Alerts containing no usable address
+	AlertsDropped         uint64 `json:"alerts-dropped"`         // Blocks discarded because the spool was full
+	AlertsDenied          uint64 `json:"alerts-denied"`          // Alerts from senders that are not permitted sensors
+	AlertsUnauthenticated uint64 `json:"alerts-unauthenticated"` // Unsigned, forged, stale or replayed alerts
+	RulesAdded            uint64 `json:"rules-added"`
+	RulesDuplicate        uint64 `json:"rules-duplicate"` // Alerts for hosts which were already blocked
+	RulesFailed           uint64 `json:"rules-failed"`
+	RulesReaped           uint64 `json:"rules-reaped"`
+	RulesStandby          uint64 `json:"rules-standby"`     // Blocks not added because this instance is the standby
+	BlocksSuppressed      uint64 `json:"blocks-suppressed"` // Blocks not added because of the rate limits or a panic
+}
+
+var stats = Stats{Started: time.Now().Unix()}
+
+// Increment one of the counters in stats
+func count(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
+
+// Return a consistent copy of the counters
+func (s *Stats) snapshot() Stats {
+	return Stats{
+		Started:               s.Started,
+		AlertsReceived:        atomic.LoadUint64(&s.AlertsReceived),
+		AlertsParsed:          atomic.LoadUint64(&s.AlertsParsed),
+		AlertsRejected:        atomic.LoadUint64(&s.AlertsRejected),
+		AlertsDropped:         atomic.LoadUint64(&s.AlertsDropped),
+		AlertsDenied:          atomic.LoadUint64(&s.AlertsDenied),
+		AlertsUnauthenticated: atomic.LoadUint64(&s.AlertsUnauthenticated),
+		RulesAdded:            atomic.LoadUint64(&s.RulesAdded),
+		RulesDuplicate:        atomic.LoadUint64(&s.RulesDuplicate),
+		RulesFailed:           atomic.LoadUint64(&s.RulesFailed),
+		RulesReaped:           atomic.LoadUint64(&s.RulesReaped),
+		RulesStandby:          atomic.LoadUint64(&s.RulesStandby),
+		BlocksSuppressed:      atomic.LoadUint64(&s.BlocksSuppressed),
+	}
+}
+
+// An AlertRecord is an alert message and what was decoded from it
+type AlertRecord struct {
+	Time    int64  `json:"time"`
+	Host    string `json:"host"`
+	Message string `json:"message"`
+	Alert   Alert  `json:"alert"`
+}
+
+// AlertLog is a fixed size ring buffer of the most recent alerts
+type AlertLog struct {
+	mutex  sync.Mutex
+	alerts []AlertRecord
+	next   int
+}
+
+var recentAlerts AlertLog
+
+// Add an alert to the log, overwriting the oldest once the log is full
+func (l *AlertLog) add(alert Alert, message string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	rec := AlertRecord{Time: time.Now().Unix(), Host: alert.Attacker, Message: message, Alert: alert}
+
+	if len(l.alerts) < maxRecentAlerts {
+		l.alerts = append(l.alerts, rec)
+		return
+	}
+
+	l.alerts[l.next] = rec
+	l.next = (l.next + 1) % maxRecentAlerts
+}
+
+// Return the alerts in the log, oldest first
+func (l *AlertLog) list() []AlertRecord {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	list := make([]AlertRecord, 0, len(l.alerts))
+	list = append(list, l.alerts[l.next:]...)
+	list = append(list, l.alerts[:l.next]...)
+	return list
+}
@@ -0,0 +1,490 @@
+// target.go describes the TNSR instances that tnsrids installs block rules on. Each target has its own address,
+// ACL, TLS material, HTTP client, circuit breaker and rule cache. Blocks are fanned out to every target, and a block
+// that fails on one target is queued and retried on that target alone, so it is never duplicated on the others
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const dfltTargetName = "default"    // Name of the target configured by the top level host/ca/cert/key options
+const retryPeriod = "@every 30s"    // How often blocks that failed on one target are retried
+const maxPendingBlocks = 10000      // Limit on the number of blocks waiting to be retried on each target
+const dfltACL string = "snortblock" // Name of the ACL that block rules are added to
+
+// Options that may be set per target. Any that are not set take the value of the top level option
+var targetOptions = []string{"host", "acl", "capath", "certpath", "keypath", "clientcert", "servername", "tlsmin", "certwarn", "authfile"}
+
+// Short names accepted for target options, matching the top level config keys
+var targetAliases = map[string]string{"ca": "capath", "cert": "certpath", "key": "keypath"}
+
+// A pendingBlock is a block that could not be added to a target and is waiting to be retried
+type pendingBlock struct {
+	Host    string `json:"host"`
+	Src     bool   `json:"src"`
+	Created uint64 `json:"created"` // When the block was first added, so that a retry does not extend its life
+	Expires uint64 `json:"expires,omitempty"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// File in which the pending blocks of every target are saved, so that they survive a restart or a fail-over. With a
+// lease it sits beside the lease file where the standby can read it on taking over, otherwise in the spool directory.
+// Empty if neither is configured, in which case the blocks are only held in memory
+var pendingPath string
+
+// A Target is a TNSR instance and the ACL on it that tnsrids maintains
+// cache, lastupdate and pending are protected by tnsrMutex. lastupdate, ruleCount and pendingCount are also written
+// atomically so that the health and metrics endpoints can read them without waiting for tnsrMutex
+type Target struct {
+	Name string
+	Host string // Address of the TNSR instance including the protocol prefix
+	ACL  string // Name of the ACL
+
+	options map[string]string // Options the target was built from, used to reload the certificates
+
+	clientMutex sync.Mutex
+	tlsConfig   *tls.Config // nil for http:// targets
+	client      *http.Client
+	user        string // HTTP basic auth credentials. Empty = no basic auth
+	password    string
+
+	breaker  CircuitBreaker
+	lastREST int64 // Epoch time of the last successful RESTCONF round-trip. Accessed atomically
+
+	cache      *ACLRuleList
+	lastupdate uint64 // When was the cache last updated from TNSR
+	pending    []pendingBlock
+
+	ruleCount    int64 // Number of rules in the cache
+	pendingCount int64 // Number of blocks waiting to be retried
+
+	certs *CertWatch // Modification and expiry times of the TLS files. Replaced on reload, under tnsrMutex
+}
+
+// A TargetConfig is the name of a target and the options it is built from
+type TargetConfig struct {
+	Name    string
+	Options map[string]string
+}
+
+// The targets, in configuration order. The first target's rules are cached in aclcache
+// The slice is replaced (not modified) on reload, under tnsrMutex and targetsMutex
+var targets []*Target
+
+// Protects the targets variable for the readers that do not hold tnsrMutex. A RESTCONF call may hold tnsrMutex for
+// a long time while TNSR is unreachable, and the health and metrics endpoints must still answer
+var targetsMutex sync.Mutex
+
+// Return the current list of targets
+func currentTargets() []*Target {
+	targetsMutex.Lock()
+	defer targetsMutex.Unlock()
+
+	return targets
+}
+
+// Record the size and age of the cache for the readers that do not hold tnsrMutex. Must be called with tnsrMutex
+// held whenever the cache changes
+func (t *Target) noteCache(updated uint64) {
+	atomic.StoreUint64(&t.lastupdate, updated)
+	atomic.StoreInt64(&t.ruleCount, int64(len(t.cache.AclRule)))
+}
+
+// Record the number of blocks waiting to be retried. Must be called with tnsrMutex held whenever pending changes
+func (t *Target) notePending() {
+	atomic.StoreInt64(&t.pendingCount, int64(len(t.pending)))
+}
+
+// Return the names of the targets that have blocks waiting to be retried
+func pendingTargets() []string {
+	var names []string
+
+	for _, t := range currentTargets() {
+		if atomic.LoadInt64(&t.pendingCount) > 0 {
+			names = append(names, t.Name)
+		}
+	}
+
+	return names
+}
+
+// Return the target's certificate watch
+func (t *Target) certWatch() *CertWatch {
+	t.clientMutex.Lock()
+	defer t.clientMutex.Unlock()
+
+	return t.certs
+}
+
+// Build a target from its options, loading its TLS material and credentials
+func newTarget(name string, options map[string]string) (*Target, error) {
+	t := &Target{Name: name, Host: options["host"], ACL: options["acl"], options: options}
+	t.breaker.name = name
+
+	u, err := url.Parse(t.Host)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("Target %s: invalid host \"%s\". Must be an http:// or https:// URL", name, t.Host)
+	}
+
+	if len(t.ACL) == 0 || strings.ContainsAny(t.ACL, "/?#") {
+		return nil, fmt.Errorf("Target %s: invalid ACL name \"%s\"", name, t.ACL)
+	}
+
+	warnDays, err := strconv.Atoi(options["certwarn"])
+	if err != nil || warnDays < 0 {
+		return nil, fmt.Errorf("Target %s: invalid certwarn \"%s\"", name, options["certwarn"])
+	}
+
+	// Attempt to initilize TLS
+	if u.Scheme == "https" {
+		if verbose {
+			fmt.Printf("Attempting TLS initialization for %s\n", name)
+		}
+
+		t.tlsConfig, err = buildTLSConfig(options)
+		if err != nil {
+			return nil, fmt.Errorf("Target %s: %v", name, err)
+		}
+	}
+
+	// The credentials in the environment are for the default target. The others must each have their own authfile
+	t.user, t.password, err = loadCredentials(options["authfile"], name == dfltTargetName)
+	if err != nil {
+		return nil, fmt.Errorf("Target %s: unable to read credentials: %v", name, err)
+	}
+
+	if len(t.user) > 0 && t.tlsConfig == nil {
+		log.Printf("WARNING: Sending RESTCONF credentials to %s without TLS", t.Host)
+	}
+
+	t.certs = newCertWatch(t, warnDays)
+	return t, nil
+}
+
+// Decode the target configurations: the default target from the top level options, followed by any in the
+// "targets" section of a YAML config file. Per target options that are not set are inherited from the top level
+func targetConfigs(options map[string]string, section *yaml.Node) ([]TargetConfig, error) {
+	var extra []map[string]string
+
+	list := []TargetConfig{{dfltTargetName, options}}
+
+	if section != nil {
+		err := section.Decode(&extra)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid targets section (line %d): %v", section.Line, err)
+		}
+	}
+
+	names := map[string]bool{dfltTargetName: true}
+
+	for idx, tc := range extra {
+		name := tc["name"]
+		if len(name) == 0 {
+			name = fmt.Sprintf("target%d", idx+1)
+		}
+
+		if names[name] {
+			return nil, fmt.Errorf("Duplicate target name \"%s\"", name)
+		}
+
+		names[name] = true
+
+		topts := make(map[string]string)
+		for _, opt := range targetOptions {
+			topts[opt] = options[opt]
+		}
+
+		for k, v := range tc {
+			k = strings.ToLower(k)
+			if alias, ok := targetAliases[k]; ok {
+				k = alias
+			}
+
+			if k == "name" {
+				continue
+			}
+
+			if _, ok := topts[k]; !ok {
+				return nil, fmt.Errorf("Target %s: unknown option \"%s\"", name, k)
+			}
+
+			if k == "clientcert" {
+				var err error
+
+				v, err = parseBool(v)
+				if err != nil {
+					return nil, fmt.Errorf("Target %s: clientcert: %v", name, err)
+				}
+			}
+
+			topts[k] = v
+		}
+
+		list = append(list, TargetConfig{name, topts})
+	}
+
+	return list, nil
+}
+
+// Build the list of targets from the options and the "targets" section of the config file
+func buildTargets(options map[string]string, section *yaml.Node) ([]*Target, error) {
+	var list []*Target
+
+	configs, err := targetConfigs(options, section)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tc := range configs {
+		t, err := newTarget(tc.Name, tc.Options)
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, t)
+	}
+
+	return list, nil
+}
+
+// Replace the targets. A target with the same name, host and ACL as an existing one takes over its cache, pending
+// blocks and circuit breaker so that a reload does not lose them. Must be called with tnsrMutex held
+func setTargets(list []*Target) {
+	old := make(map[string]*Target)
+	for _, t := range targets {
+		old[t.Name] = t
+	}
+
+	for idx, t := range list {
+		if o, ok := old[t.Name]; ok && o.Host == t.Host && o.ACL == t.ACL {
+			o.update(t)
+			list[idx] = o
+			continue
+		}
+
+		t.cache = &ACLRuleList{}
+		t.noteCache(0)
+	}
+
+	// The first target is cached in aclcache. A target that is no longer first gets a copy
+	for _, t := range list[1:] {
+		if t.cache == &aclcache {
+			rules := aclcache
+			t.cache = &rules
+		}
+	}
+
+	if list[0].cache != &aclcache {
+		aclcache = *list[0].cache
+		list[0].cache = &aclcache
+	}
+
+	targetsMutex.Lock()
+	targets = list
+	targetsMutex.Unlock()
+
+	// The blocks waiting for a removed target are dropped
+	savePending()
+}
+
+// Take the TLS material and credentials from a newly built copy of the target. Must be called with tnsrMutex held
+func (t *Target) update(n *Target) {
+	t.clientMutex.Lock()
+	defer t.clientMutex.Unlock()
+
+	t.options = n.options
+	t.tlsConfig = n.tlsConfig
+	t.user = n.user
+	t.password = n.password
+	t.certs = newCertWatch(t, n.certs.warnDays)
+	t.resetClientLocked()
+}
+
+// Queue a block that failed on this target to be retried. Must be called with tnsrMutex held, followed by savePending()
+func (t *Target) queueRetry(pb pendingBlock) {
+	for _, p := range t.pending {
+		if p.Host == pb.Host {
+			return
+		}
+	}
+
+	if len(t.pending) >= maxPendingBlocks {
+		log.Printf("ERROR: Too many blocks waiting for %s. Dropping block for \"%s\"", t.Name, t.pending[0].Host)
+		t.pending = t.pending[1:]
+	}
+
+	t.pending = append(t.pending, pb)
+	t.notePending()
+}
+
+// Forget a block waiting to be retried, because the host has been unblocked. Must be called with tnsrMutex held
+func (t *Target) dropPending(host string) {
+	for idx, p := range t.pending {
+		if p.Host == host {
+			t.pending = append(t.pending[:idx], t.pending[idx+1:]...)
+			t.notePending()
+			savePending()
+			return
+		}
+	}
+}
+
+// Replace the pending blocks with those saved in pendingPath, if there are any. Called at start-up and on becoming
+// the leader, since the previous leader may have left blocks to retry. Must be called with tnsrMutex held
+func loadPending() {
+	if len(pendingPath) == 0 {
+		return
+	}
+
+	data, err := ioutil.ReadFile(pendingPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("ERROR: Unable to read the pending blocks: %v", err)
+		}
+
+		return
+	}
+
+	saved := make(map[string][]pendingBlock)
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		log.Printf("ERROR: Ignoring invalid pending blocks in %s: %v", pendingPath, err)
+		return
+	}
+
+	for _, t := range targets {
+		t.pending = saved[t.Name]
+		t.notePending()
+
+		if len(t.pending) > 0 {
+			log.Printf("INFO: %d blocks waiting to be retried on %s", len(t.pending), t.Name)
+		}
+	}
+}
+
+// Save the pending blocks of every target to pendingPath. Must be called with tnsrMutex held whenever they change
+// The standby leaves the file to the leader
+func savePending() {
+	if len(pendingPath) == 0 || !isLeader() {
+		return
+	}
+
+	saved := make(map[string][]pendingBlock)
+	for _, t := range targets {
+		if len(t.pending) > 0 {
+			saved[t.Name] = t.pending
+		}
+	}
+
+	data, err := json.Marshal(saved)
+	if err == nil {
+		err = writeFileAtomic(pendingPath, data, 0600)
+	}
+
+	if err != nil {
+		log.Printf("ERROR: Unable to save the pending blocks: %v", err)
+	}
+}
+
+// Retry the blocks that failed on each target. Run periodically from cron
+func retryPendingBlocks() {
+	tnsrMutex.Lock()
+	defer tnsrMutex.Unlock()
+
+	// The blocks are kept until this instance is the leader again
+	if !isLeader() {
+		return
+	}
+
+	now := uint64(time.Now().Unix())
+	changed := false
+
+	for _, t := range targets {
+		before := len(t.pending)
+
+		for len(t.pending) > 0 && t.breaker.ready() {
+			pb := t.pending[0]
+
+			if pb.Created == 0 {
+				pb.Created = now
+			}
+
+			// No point adding a rule that would be reaped straight away
+			expires := pb.Expires
+			if expires == 0 && maxruleage > 0 {
+				expires = pb.Created + maxruleage
+			}
+
+			if expires > 0 && expires < now {
+				t.pending = t.pending[1:]
+				continue
+			}
+
+			err := t.addRule(context.Background(), pb.Host, pb.Src, pb.Created, pb.Expires, pb.Comment)
+			if err != nil && retryable(err) {
+				break
+			}
+
+			if err == nil {
+				log.Printf("INFO: Block for \"%s\" added to %s on retry", pb.Host, t.Name)
+			}
+
+			t.pending = t.pending[1:]
+		}
+
+		t.notePending()
+		changed = changed || len(t.pending) != before
+	}
+
+	if changed {
+		savePending()
+	}
+}
+
+// Sleep until it is worth trying the targets again, or ctx is cancelled
+func waitForTargets(ctx context.Context) {
+	d := maxBackoff
+
+	for _, t := range currentTargets() {
+		if w := t.breaker.remaining(); w > 0 && w < d {
+			d = w
+		}
+	}
+
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+}
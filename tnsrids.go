@@ -21,14 +21,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/robfig/cron"
 	"gopkg.in/natefinch/lumberjack.v2" // Log writer/rotator
+	"gopkg.in/yaml.v3"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -49,14 +55,64 @@ func main() {
 	// Tell it what options and arguments to look for
 	//					name, cmd line arg, string vs bool, help text
 	tconfig.addOption("verbose", "v", false, "Output log messages to the console", "no")
+	tconfig.addOption("checkconfig", "check-config", false, "Check the configuration, report any problems and exit", "no")
 	tconfig.addOption("show", "show", false, "List the current block rules and exit", "no")
 	tconfig.addOption("reap", "reap", false, "Delete block rules older than <config> minutes and exit", "no")
-	tconfig.addOption("host", "h", true, "Host name of TNSR instance (including protocol prefix", dfltHost)
-	tconfig.addOption("port", "p", true, "UDP port on which to listen for alert messages", dfltPort)
-	tconfig.addOption("capath", "ca", true, "TLS certificate authority file path", dfltCA)
-	tconfig.addOption("certpath", "cert", true, "TLS certificate file path", dfltCert)
-	tconfig.addOption("keypath", "key", true, "TLS key file path", dfltKey)
-	tconfig.addOption("maxage", "m", true, "Maximum age of rules before deletion. 0 = never delete", dfltMaxage)
+	tconfig.addTypedOption("host", "h", optURL, 0, "Host name of TNSR instance (including protocol prefix", dfltHost)
+	tconfig.addTypedOption("port", "p", optInt, 0, "UDP port on which to listen for alert messages", dfltPort)
+	tconfig.addTypedOption("capath", "ca", optCAPath, 0, "TLS certificate authority file path. system = use the system CAs", dfltCA)
+	tconfig.addTypedOption("certpath", "cert", optPath, 0, "TLS certificate file path", dfltCert)
+	tconfig.addTypedOption("keypath", "key", optPath, 0, "TLS key file path", dfltKey)
+	tconfig.addOption("clientcert", "clientcert", false, "Present a TLS client certificate. no = verify the server certificate only", "yes")
+	tconfig.addOption("servername", "servername", true, "Server name for TLS SNI and certificate verification, if different from host", "")
+	tconfig.addOption("tlsmin", "tlsmin", true, "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3", dfltTLSMin)
+	tconfig.addTypedOption("certwarn", "certwarn", optInt, 0, "Warn when the TLS client certificate or CA expires within <days>", dfltCertWarn)
+	tconfig.addTypedOption("authfile", "authfile", optPath, 0, "File containing username:password for RESTCONF basic auth", "")
+	tconfig.addOption("acl", "acl", true, "Name of the TNSR ACL to which block rules are added", dfltACL)
+	tconfig.addSection("targets")
+	tconfig.addSection("patterns")
+	tconfig.addSection("sensors")
+	tconfig.addTypedOption("maxage", "m", optDuration, time.Minute, "Maximum age of rules before deletion. 0 = never delete", dfltMaxage)
+	tconfig.addOption("format", "format", true, "Output format for -show: table, json or csv", fmtTable)
+	tconfig.addTypedOption("contains", "contains", optCIDRList, 0, "Show only rules overlapping <cidr>, or any of a comma separated list", "")
+	tconfig.addTypedOption("olderthan", "olderthan", optDuration, time.Minute, "Show only rules at least <minutes> old", "")
+	tconfig.addTypedOption("newerthan", "newerthan", optDuration, time.Minute, "Show only rules at most <minutes> old", "")
+	tconfig.addTypedOption("expiring", "expiring", optDuration, time.Minute, "Show only rules expiring within <minutes>", "")
+	tconfig.addOption("managed", "managed", false, "Show only rules added by tnsrids", "no")
+	tconfig.addOption("action", "action", true, "Show only rules with this action (deny, permit)", "")
+	tconfig.addOption("sort", "sort", true, "Sort -show output by seq, age or addr", "")
+	tconfig.addTypedOption("timeout", "timeout", optDuration, time.Second, "Timeout in seconds for each RESTCONF call", dfltTimeout)
+	tconfig.addTypedOption("retries", "retries", optInt, 0, "Number of times a failed RESTCONF call is retried", dfltRetries)
+	tconfig.addOption("spool", "spool", true, "Directory in which pending blocks are spooled. Empty = disabled", "")
+	tconfig.addTypedOption("spoolmax", "spoolmax", optInt, 0, "Maximum number of pending blocks in the spool", dfltSpoolMax)
+	tconfig.addOption("overflow", "overflow", true, "Spool overflow policy: drop-new or drop-oldest", dropNew)
+	tconfig.addTypedOption("drain", "drain", optDuration, time.Second, "Seconds to wait for queued hosts to be blocked on shutdown", dfltDrain)
+	tconfig.addOption("failopen", "failopen", false, "Remove all rules added by tnsrids on exit", "no")
+	tconfig.addOption("lease", "lease", true, "Lease file on shared storage for active/standby operation. Empty = disabled", "")
+	tconfig.addTypedOption("leasettl", "leasettl", optDuration, time.Second, "Seconds the lease remains valid unless renewed", dfltLeaseTTL)
+	tconfig.addTypedOption("allow", "allow", optCIDRList, 0, "Addresses or prefixes permitted to send alerts. Empty = any sender", "")
+	tconfig.addOption("signed", "signed", false, "Drop alerts that are not signed by a sensor", "no")
+	tconfig.addTypedOption("signwindow", "signwindow", optDuration, time.Second, "Seconds by which the time in a signed alert may differ from the local clock", dfltSignWindow)
+	tconfig.addOption("forward", "forward", true, "Sign alerts read from stdin and send them to the tnsrids listener at <host:port>", "")
+	tconfig.addOption("sensor", "sensor", true, "Name of this sensor, for -forward", "")
+	tconfig.addTypedOption("sensorkey", "sensorkey", optPath, 0, "File containing the key with which -forward signs alerts", "")
+	tconfig.addTypedOption("ratelimit", "ratelimit", optInt, 0, "Maximum new blocks per minute from alerts. 0 = unlimited", "0")
+	tconfig.addTypedOption("sensorrate", "sensorrate", optInt, 0, "Maximum new blocks per minute from each sensor's alerts. 0 = unlimited", "0")
+	tconfig.addTypedOption("panic", "panic", optInt, 0, "Stop automatic blocking if more new blocks than this are requested in a minute. 0 = never", "0")
+	tconfig.addOption("alertformat", "alertformat", true, "Format of the alerts received by the UDP listener: auto, syslog, fast, eve, snort3, regex or generic", fmtAuto)
+	tconfig.addOption("follow", "follow", true, "Comma separated list of alert files to follow. Empty = disabled", "")
+	tconfig.addOption("followstate", "followstate", true, "File in which the position in each followed file is saved. Empty = start at the end", "")
+	tconfig.addOption("followformat", "followformat", true, "Format of the alerts in the followed files", fmtAuto)
+	tconfig.addOption("u2dir", "u2dir", true, "Directory containing Snort unified2 files to read. Empty = disabled", "")
+	tconfig.addOption("u2base", "u2base", true, "Base name of the unified2 files", dfltU2Base)
+	tconfig.addOption("u2waldo", "u2waldo", true, "File in which the position in the unified2 files is saved. Empty = <u2dir>/<u2base>.waldo", "")
+	tconfig.addOption("api", "api", true, "Address (host:port) for the local management API. Empty = disabled", "")
+	tconfig.addOption("apiremote", "apiremote", false, "Allow the management API, which has no authentication, to listen on an address that is not a loopback address", "no")
+	tconfig.addOption("metrics", "metrics", true, "Address (host:port) for a separate Prometheus /metrics listener. Empty = disabled", "")
+	tconfig.addOption("block", "block", true, "Add a block rule for <cidr> and exit", "")
+	tconfig.addOption("unblock", "unblock", true, "Remove the block rule for <cidr> or sequence number and exit", "")
+	tconfig.addTypedOption("duration", "duration", optDuration, time.Minute, "Lifetime in minutes of a rule added with -block", "")
+	tconfig.addOption("reason", "reason", true, "Reason for a -block or -unblock, recorded in the log", "not specified")
 
 	// Now process the command line & config file into a map of options and values
 	options := tconfig.read()
@@ -66,33 +122,48 @@ func main() {
 		return
 	}
 
-	// Update the global vars
-	if options["verbose"] == "yes" {
-		verbose = true
+	// Report every problem with the configuration and quit
+	if options["checkconfig"] == "yes" {
+		os.Exit(checkConfig(tconfig, options))
 	}
 
-	tnsrhost = options["host"]
-	maxruleage, _ = strconv.ParseUint(options["maxage"], 10, 64)
-	maxruleage *= 60 // Convert to seconds
-	port := options["port"]
+	if errs := tconfig.errors(); len(errs) > 0 {
+		for _, p := range errs {
+			fmt.Println(p)
+		}
 
-	// Attempt to initilize TLS
-	useTLS = false
+		log.Fatal("Invalid configuration")
+	}
 
-	if strings.HasPrefix(tnsrhost, "https://") {
-		err = TLSSetup(options["capath"], options["certpath"], options["keypath"])
+	// Sign and forward alerts from the sensor, which needs no TNSR configuration, until stdin is closed
+	if len(options["forward"]) > 0 {
+		err := forwardAlerts(os.Stdin, options["forward"], options["sensor"], options["sensorkey"])
 		if err != nil {
-			if verbose {
-				fmt.Println(err)
-			}
+			log.Fatalf("Unable to forward alerts: %v", err)
+		}
 
-			log.Fatal(err)
+		return
+	}
+
+	// Update the global vars
+	err = applyOptions(options, tconfig.file.sections)
+	if err != nil {
+		if verbose {
+			fmt.Println(err)
 		}
+
+		log.Fatal(err)
 	}
 
+	port := options["port"]
+
 	// Just list the installed ACL rules and quit
 	if options["show"] == "yes" {
-		err := showACLs()
+		filter, err := newRuleFilter(options)
+		if err == nil {
+			err = showACLs(options["format"], filter)
+		}
+
 		if err != nil {
 			fmt.Printf("Unable to retrieve rules: %v\n", err)
 		}
@@ -109,39 +180,300 @@ func main() {
 		return
 	}
 
-	// Set up a timer for regular tasks if maxruleage > 0
-	tnsrCron := cron.New()
-	if maxruleage > 0 {
-		// Such as reaping old rules
-		tnsrCron.AddFunc(reapPeriod, func() { reapACLs() })
-		tnsrCron.Start()
+	// Manually block a host and quit. Nothing is left to retry a target that could not be reached, so the block
+	// has failed on that target
+	if len(options["block"]) > 0 {
+		err := blockHost(options["block"], options["duration"], options["reason"], operatorName())
+		if names := pendingTargets(); err == nil && len(names) > 0 {
+			err = fmt.Errorf("Not added on %s", strings.Join(names, ", "))
+		}
+
+		if err != nil {
+			fmt.Printf("ERROR: Failed to block %s: %v\n", options["block"], err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	// Manually remove a block rule and quit
+	if len(options["unblock"]) > 0 {
+		err := unblockHost(options["unblock"], options["reason"], operatorName())
+		if err != nil {
+			fmt.Printf("ERROR: Failed to unblock %s: %v\n", options["unblock"], err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	// The API can change the rules, so it is only reachable from elsewhere if that is asked for
+	if len(options["api"]) > 0 {
+		err = checkAPIAddr(options["api"], options["apiremote"] == "yes")
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	// Prepare a handler to catch terminating signals (^C etc)
+	// Prepare a handler to catch terminating signals (^C etc, and SIGTERM from systemd)
+	// Cancelling the context stops the listener and lets processHosts() drain the queue
+	ctx, cancel := context.WithCancel(context.Background())
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	// SIGHUP re-reads the configuration file
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
 	go func() {
-		<-c
+		current := options
+		for range hup {
+			current = reloadConfig(&tconfig, current)
+		}
+	}()
+
+	go func() {
+		sig := <-c
 		if verbose {
 			fmt.Println("Cleaning up and exiting")
 		}
 
-		// Close the cron process
-		if maxruleage > 0 {
-			tnsrCron.Stop()
+		log.Printf("INFO: Received %v. Shutting down", sig)
+		cancel()
+	}()
+
+	// Blocks that failed on some of the targets are saved where the next leader, or the next run, will find them
+	switch {
+	case len(options["lease"]) > 0:
+		pendingPath = options["lease"] + ".pending"
+	case len(options["spool"]) > 0:
+		pendingPath = filepath.Join(options["spool"], "pending.json")
+	}
+
+	// With a lease, find out whether this instance is the leader before touching any rules or starting the jobs
+	if len(options["lease"]) > 0 {
+		ttl, _ := parseDuration(options["leasettl"], time.Second)
+		lease, err = newLease(options["lease"], ttl)
+		if err != nil {
+			log.Fatalf("Unable to set up the lease: %v", err)
 		}
 
-		os.Exit(2)
-	}()
+		if lease.renew() {
+			lease.takeOver()
+		}
+
+		go lease.run(ctx)
+	} else {
+		tnsrMutex.Lock()
+		loadPending()
+		tnsrMutex.Unlock()
+	}
 
-	// Clean out any old rules
+	// Set up a timer for regular tasks
+	// Such as reaping old rules. This runs even if maxage is 0, since rules may have been given their own expiry
+	tnsrCron := cron.New()
+	tnsrCron.AddFunc(reapPeriod, func() { reapACLs() })
+
+	// And picking up rotated certificates
+	tnsrCron.AddFunc(certCheckPeriod, checkCerts)
+
+	// And retrying blocks that failed on some of the targets
+	tnsrCron.AddFunc(retryPeriod, retryPendingBlocks)
+
+	// And keeping the standby's cache warm
+	if len(options["lease"]) > 0 {
+		tnsrCron.AddFunc(reapPeriod, warmStandbyCache)
+	}
+	tnsrCron.Start()
+
+	// Clean out any old rules. If TNSR is not reachable yet, carry on and let /readyz report it
 	err = reapACLs()
 	if err != nil {
-		log.Fatal("Unable to reap old rules prior to starting server")
+		log.Printf("ERROR: Unable to reap old rules prior to starting server: %v", err)
+	}
+
+	// Open the spool and replay any blocks left from a previous run
+	if len(options["spool"]) > 0 {
+		spoolmax, _ := strconv.Atoi(options["spoolmax"])
+		spool, err = openSpool(options["spool"], spoolmax, options["overflow"])
+		if err != nil {
+			log.Fatalf("Unable to open spool: %v", err)
+		}
+	}
+
+	dec, err := newDecoder(options["alertformat"])
+	if err != nil {
+		log.Fatalf("Invalid alertformat: %v", err)
+	}
+
+	// Follow alert files written by the IDS
+	if len(options["follow"]) > 0 {
+		fdec, err := newDecoder(options["followformat"])
+		if err != nil {
+			log.Fatalf("Invalid followformat: %v", err)
+		}
+
+		go followFiles(ctx, strings.Split(options["follow"], ","), options["followstate"], fdec, hostQueue)
+	}
+
+	// Read the unified2 files written by Snort
+	if len(options["u2dir"]) > 0 {
+		go newU2Reader(options["u2dir"], options["u2base"], options["u2waldo"]).run(ctx, hostQueue)
 	}
 
+	var servers []*http.Server
+
+	// Start the management API if configured
+	if len(options["api"]) > 0 {
+		servers = append(servers, startAPI(options["api"]))
+	}
+
+	// Metrics are always available via the API, but may also be served on their own address
+	if len(options["metrics"]) > 0 {
+		servers = append(servers, startMetrics(options["metrics"]))
+	}
+
+	drain, _ := parseDuration(options["drain"], time.Second)
+
 	// And finally start the UDP listener
 	// This also starts a number of go routines to process Snort alerts and update the TNSR instance
-	startServer(port)
+	// It returns once a terminating signal has been received and the queue drained
+	startServer(ctx, port, dec, drain)
+
+	// Close the cron process
+	tnsrCron.Stop()
+
+	for _, srv := range servers {
+		sctx, scancel := context.WithTimeout(context.Background(), 5*time.Second)
+		srv.Shutdown(sctx)
+		scancel()
+	}
+
+	// In fail-open mode nothing should remain blocked while tnsrids is not running. The standby leaves the
+	// leader's rules alone
+	tnsrMutex.Lock()
+	remove := failOpen
+	tnsrMutex.Unlock()
+
+	if remove && isLeader() {
+		err = removeManagedRules()
+		if err != nil {
+			log.Printf("ERROR: Fail-open: unable to remove block rules: %v", err)
+		}
+	}
+
+	if lease != nil {
+		lease.release()
+	}
+
+	log.Printf("INFO: tnsrids stopped")
+}
+
+// Validate the options that can be changed while running and update the global vars. Used at start-up and when the
+// configuration is reloaded. sections holds the structured sections of a YAML config file, which may list extra
+// targets. Nothing is changed unless all of the options are valid
+func applyOptions(options map[string]string, sections map[string]*yaml.Node) error {
+	maxage, err := parseDuration(options["maxage"], time.Minute)
+	if err != nil {
+		return fmt.Errorf("Invalid maxage: %v", err)
+	}
+
+	timeout, err := parseDuration(options["timeout"], time.Second)
+	if err != nil || timeout == 0 {
+		return fmt.Errorf("Invalid timeout \"%s\"", options["timeout"])
+	}
+
+	retries, err := strconv.Atoi(options["retries"])
+	if err != nil || retries < 0 {
+		return fmt.Errorf("Invalid retries \"%s\"", options["retries"])
+	}
+
+	list, err := buildTargets(options, sections["targets"])
+	if err != nil {
+		return err
+	}
+
+	pats, err := compilePatterns(sections["patterns"])
+	if err != nil {
+		return err
+	}
+
+	sens, err := buildSensors(options["allow"], sections["sensors"])
+	if err != nil {
+		return err
+	}
+
+	window, err := parseDuration(options["signwindow"], time.Second)
+	if err != nil || window == 0 {
+		return fmt.Errorf("Invalid signwindow \"%s\"", options["signwindow"])
+	}
+
+	var limits [3]int
+	for idx, opt := range []string{"ratelimit", "sensorrate", "panic"} {
+		limits[idx], err = strconv.Atoi(options[opt])
+		if err != nil || limits[idx] < 0 {
+			return fmt.Errorf("Invalid %s \"%s\"", opt, options[opt])
+		}
+	}
+
+	setPatterns(pats)
+	setSensors(sens)
+	setSigning(options["signed"] == "yes", window)
+	limiter.set(limits[0], limits[1], limits[2])
+
+	// Hold the mutex so that nothing is talking to TNSR while the settings change
+	tnsrMutex.Lock()
+	defer tnsrMutex.Unlock()
+
+	verbose = options["verbose"] == "yes"
+	failOpen = options["failopen"] == "yes"
+	maxruleage = uint64(maxage.Seconds())
+	restTimeout = timeout
+	restRetries = retries
+	setTargets(list)
+
+	return nil
+}
+
+// Print every problem found in the configuration. Returns the exit status: 0 if the configuration is valid
+func checkConfig(cfg Config, options map[string]string) int {
+	invalid := len(cfg.errors()) > 0
+
+	for _, p := range cfg.problems {
+		fmt.Println(p)
+	}
+
+	_, err := targetConfigs(options, cfg.file.sections["targets"])
+	if err != nil {
+		fmt.Println(err)
+		invalid = true
+	}
+
+	_, err = compilePatterns(cfg.file.sections["patterns"])
+	if err != nil {
+		fmt.Println(err)
+		invalid = true
+	}
+
+	_, err = buildSensors(options["allow"], cfg.file.sections["sensors"])
+	if err != nil {
+		fmt.Println(err)
+		invalid = true
+	}
+
+	for _, opt := range []string{"alertformat", "followformat"} {
+		_, err = newDecoder(options[opt])
+		if err != nil {
+			fmt.Printf("%s: %v\n", opt, err)
+			invalid = true
+		}
+	}
+
+	if invalid {
+		fmt.Println("Configuration is invalid")
+		return 1
+	}
+
+	fmt.Println("Configuration OK")
+	return 0
 }
@@ -17,8 +17,33 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 // Creat a set of program options and ensure that they are combined in a manner that lets the command line
@@ -126,3 +151,1523 @@ func TestRuleExists(t *testing.T) {
 		t.Errorf("Src 192.168.10.100 should exist, but it does not")
 	}
 }
+
+// Ensure that creation and expiry times are extracted from rule descriptions
+func TestRuleTimes(t *testing.T) {
+	var tests = []struct {
+		descr   string
+		created uint64
+		expires uint64
+		valid   bool
+	}{
+		{"1546300800, Added by tnsrids", 1546300800, 0, true},
+		{"1546300800, Added by tnsrids (manual), expires 1546304400", 1546300800, 1546304400, true},
+		{"Added by hand", 0, 0, false},
+		{"0, Added by tnsrids", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		created, expires, err := ruleTimes(test.descr)
+		if (err == nil) != test.valid || created != test.created || expires != test.expires {
+			t.Errorf("ruleTimes(\"%s\") returned %d, %d, %v", test.descr, created, expires, err)
+		}
+	}
+}
+
+// Ensure that -show filters select rules by prefix containment, age, expiry and management
+func TestRuleFilter(t *testing.T) {
+	now := int64(1546300800)
+	rules := []RuleInfo{
+		{Sequence: 1, Prefix: "203.0.113.10/32", Action: "deny", Managed: true, Created: now - 600, Expires: now + 3000, Remaining: 3000},
+		{Sequence: 2, Prefix: "198.51.100.0/24", Action: "deny", Managed: true, Created: now - 3000, Expires: now + 600, Remaining: 600},
+		{Sequence: 2147483646, Prefix: "", Action: "permit"},
+	}
+
+	var tests = []struct {
+		options  map[string]string
+		selected []uint64
+	}{
+		{map[string]string{}, []uint64{1, 2, 2147483646}},
+		{map[string]string{"contains": "203.0.113.10"}, []uint64{1}},
+		{map[string]string{"contains": "198.51.100.77"}, []uint64{2}},
+		{map[string]string{"contains": "192.0.2.0/24, 198.51.100.77"}, []uint64{2}},
+		{map[string]string{"contains": "203.0.113.10,198.51.100.0/25"}, []uint64{1, 2}},
+		{map[string]string{"olderthan": "20"}, []uint64{2}},
+		{map[string]string{"newerthan": "20"}, []uint64{1}},
+		{map[string]string{"expiring": "15"}, []uint64{2}},
+		{map[string]string{"managed": "yes", "sort": "addr"}, []uint64{2, 1}},
+		{map[string]string{"action": "permit"}, []uint64{2147483646}},
+	}
+
+	for _, test := range tests {
+		filter, err := newRuleFilter(test.options)
+		if err != nil {
+			t.Errorf("newRuleFilter(%v) failed: %v", test.options, err)
+			continue
+		}
+
+		filter.timestamp = now
+		var seqs []uint64
+		for _, ri := range filter.apply(rules) {
+			seqs = append(seqs, ri.Sequence)
+		}
+
+		if !reflect.DeepEqual(seqs, test.selected) {
+			t.Errorf("Filter %v selected %v, expected %v", test.options, seqs, test.selected)
+		}
+	}
+}
+
+// Ensure that the rules are written as JSON and CSV with their decoded times, and that the JSON can be read back
+func TestShowFormats(t *testing.T) {
+	now := int64(1546300800)
+	list := []RuleInfo{
+		newRuleInfo(0, AAclRule{Sequence: 1, SrcIPPrefix: "203.0.113.10/32", Action: "deny",
+			AclRuleDescription: fmt.Sprintf("%d, Added by tnsrids (manual), expires %d", now-600, now+600)}, now),
+		newRuleInfo(1, AAclRule{Sequence: 2147483646, Action: "permit", DstIPPrefix: "0.0.0.0/0"}, now),
+	}
+
+	list[0].Target, list[1].Target = "a", "a"
+
+	var buf bytes.Buffer
+	if err := printJSON(&buf, list); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded []RuleInfo
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || !reflect.DeepEqual(decoded, list) {
+		t.Errorf("Expected %v from the JSON but got %v (%v)", list, decoded, err)
+	}
+
+	buf.Reset()
+	if err := printCSV(&buf, list); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil || len(rows) != 3 {
+		t.Fatalf("Expected a header and two rows but got %v (%v)", rows, err)
+	}
+
+	expected := []string{"0", "1", "src", "203.0.113.10/32", "deny", "true", fmtTime(now - 600), fmtTime(now + 600), "600",
+		fmt.Sprintf("%d, Added by tnsrids (manual), expires %d", now-600, now+600), "a"}
+	if rows[0][0] != "index" || !reflect.DeepEqual(rows[1], expected) {
+		t.Errorf("Expected %v but got %v", expected, rows[1])
+	}
+
+	if rows[2][2] != "dst" || rows[2][5] != "false" || rows[2][6] != "" || rows[2][7] != "" {
+		t.Errorf("Unexpected row for the default rule: %v", rows[2])
+	}
+
+	if err := listACLs(list, "xml", RuleFilter{}); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
+
+// Ensure that histogram observations are counted in the correct cumulative buckets
+func TestHistogram(t *testing.T) {
+	h := Histogram{buckets: []float64{0.1, 1}}
+
+	h.observe("GET", "200", 0.05)
+	h.observe("GET", "200", 0.5)
+	h.observe("GET", "200", 5)
+
+	var b bytes.Buffer
+	h.write(&b, "test", "Test histogram")
+
+	for _, line := range []string{
+		`test_bucket{method="GET",status="200",le="0.1"} 1`,
+		`test_bucket{method="GET",status="200",le="1"} 2`,
+		`test_bucket{method="GET",status="200",le="+Inf"} 3`,
+		`test_count{method="GET",status="200"} 3`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("Histogram output does not contain \"%s\":\n%s", line, b.String())
+		}
+	}
+}
+
+// Ensure that a target name is escaped in the metrics labels, so that it can not break the exposition format
+func TestMetricLabels(t *testing.T) {
+	tgt, err := newTarget("edge \"1\"\\\nx", map[string]string{"host": "http://192.0.2.1", "acl": dfltACL, "certwarn": "30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tnsrMutex.Lock()
+	setTargets([]*Target{tgt})
+	tnsrMutex.Unlock()
+
+	var buf bytes.Buffer
+	writeTargetMetrics(&buf)
+
+	expected := `tnsrids_rules{target="edge \"1\"\\\nx"} 0`
+	if !strings.Contains(buf.String(), expected+"\n") {
+		t.Errorf("Expected %s in %s", expected, buf.String())
+	}
+
+	tnsrMutex.Lock()
+	targets = nil
+	tnsrMutex.Unlock()
+}
+
+// Ensure that the circuit breaker opens after repeated retryable failures and is closed again by a success
+func TestCircuitBreaker(t *testing.T) {
+	var b CircuitBreaker
+	fail := &RESTError{Status: 503, Err: errors.New("Service unavailable")}
+
+	for idx := 0; idx < breakerThreshold-1; idx++ {
+		b.record(fail)
+	}
+
+	if b.isOpen() || !b.allow() {
+		t.Errorf("Breaker opened before %d failures", breakerThreshold)
+	}
+
+	// A client error is not a sign that TNSR is unreachable
+	b.record(&RESTError{Status: 400, Err: errors.New("Bad request")})
+	for idx := 0; idx < breakerThreshold; idx++ {
+		b.record(fail)
+	}
+
+	if !b.isOpen() || b.allow() {
+		t.Errorf("Breaker should be open after %d failures", breakerThreshold)
+	}
+
+	// After the cooldown one trial call is allowed, and if it fails the breaker stays open
+	b.openUntil = time.Now()
+	if !b.allow() || b.allow() {
+		t.Errorf("Expected a single trial call after the cooldown")
+	}
+
+	b.record(fail)
+	if b.allow() {
+		t.Errorf("Breaker should stay open after a failed trial call")
+	}
+
+	b.record(nil)
+	if b.isOpen() {
+		t.Errorf("Breaker should close after a successful call")
+	}
+}
+
+// Ensure that spooled blocks are replayed in order after the spool is re-opened, and that the overflow policy is applied
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tnsrids-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	s, err := openSpool(dir, 3, dropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"192.0.2.1/32", "192.0.2.2/32", "192.0.2.3/32", "192.0.2.4/32"} {
+		if err := s.push(host); err != nil {
+			t.Errorf("push(%s) failed: %v", host, err)
+		}
+	}
+
+	// Simulate a restart
+	s, err = openSpool(dir, 3, dropNew)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"192.0.2.2/32", "192.0.2.3/32"} {
+		id, host, _ := s.next(context.Background())
+		if host != expected {
+			t.Errorf("Expected spooled host %s but got %s", expected, host)
+		}
+
+		s.done(id)
+	}
+
+	s.push("192.0.2.5/32")
+	s.push("192.0.2.6/32")
+	if err := s.push("192.0.2.7/32"); err == nil {
+		t.Errorf("push() to a full spool should fail with the drop-new policy")
+	}
+
+	if s.len() != 3 {
+		t.Errorf("Expected 3 spooled blocks, found %d", s.len())
+	}
+}
+
+// Ensure that config file values are checked against their kind and that problems are reported with their line number
+func TestConfigValidate(t *testing.T) {
+	f, err := ioutil.TempFile("", "tnsrids-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(f.Name())
+	f.WriteString("# Comment\nhost = ftp://tnsr\nmaxage = 2h\nm = 90\nretries = -1\nunknown = 1\nfailopen = true\nnot a setting\n")
+	f.Close()
+
+	var tconfig Config
+	tconfig.addTypedOption("host", "h", optURL, 0, "Host name of TNSR instance", dfltHost)
+	tconfig.addTypedOption("maxage", "m", optDuration, time.Minute, "Maximum age of rules", dfltMaxage)
+	tconfig.addTypedOption("retries", "retries", optInt, 0, "Number of retries", dfltRetries)
+	tconfig.addOption("failopen", "failopen", false, "Remove all rules on exit", "no")
+
+	cf, err := readConfigFile(f.Name(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged := tconfig.mergeItems(map[string]string{}, tconfig.resolveKeys(&cf))
+	problems := append(cf.problems, tconfig.validate(merged, cf)...)
+
+	lines := make(map[int]bool)
+	for _, p := range problems {
+		lines[p.line] = true
+	}
+
+	// ftp URL, negative retries, unknown key and the malformed line
+	expected := map[int]bool{2: true, 5: true, 6: true, 8: true}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected problems on lines %v, but found %v", expected, problems)
+	}
+
+	// "m" is an alias for "maxage" and appears later in the file
+	if merged["maxage"] != "90" || merged["failopen"] != "yes" {
+		t.Errorf("Unexpected merged values %v", merged)
+	}
+}
+
+// Ensure that nested YAML options are flattened, lists are joined and that the environment overrides the config file
+func TestYAMLConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "tnsrids-conf*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(f.Name())
+	f.WriteString("tnsr:\n  host: https://tnsr.example.com\n  tls:\n    ca: /tmp/ca.crt\nmaxage: 2h\ncontains:\n  - 192.0.2.0/24\n  - 198.51.100.7\ntargets:\n  - name: edge1\n")
+	f.Close()
+
+	var tconfig Config
+	tconfig.addTypedOption("host", "h", optURL, 0, "Host name of TNSR instance", dfltHost)
+	tconfig.addTypedOption("capath", "ca", optPath, 0, "TLS certificate authority file path", dfltCA)
+	tconfig.addTypedOption("maxage", "m", optDuration, time.Minute, "Maximum age of rules", dfltMaxage)
+	tconfig.addTypedOption("contains", "contains", optCIDRList, 0, "Show only rules overlapping <cidr>", "")
+	tconfig.addSection("targets")
+
+	cf, err := readConfigFile(f.Name(), tconfig.sections)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv(envName("maxage"), "30")
+	defer os.Unsetenv(envName("maxage"))
+
+	merged := tconfig.mergeItems(map[string]string{}, tconfig.readEnv(), tconfig.resolveKeys(&cf))
+	expected := map[string]string{"host": "https://tnsr.example.com", "capath": "/tmp/ca.crt", "maxage": "30", "contains": "192.0.2.0/24,198.51.100.7"}
+
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Expected %v but received %v", expected, merged)
+	}
+
+	if cf.sections["targets"] == nil || len(cf.problems) != 0 {
+		t.Errorf("Expected a targets section and no problems, found %v", cf.problems)
+	}
+}
+
+// Ensure that a reload applies valid settings, keeps the start-up only settings until a restart, and rejects an
+// invalid configuration as a whole
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tnsrids-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := dir + "/tnsrids.conf"
+	var tconfig Config
+	tconfig.addTypedOption("host", "h", optURL, 0, "Host name of TNSR instance", dfltHost)
+	tconfig.addTypedOption("port", "p", optInt, 0, "UDP port", dfltPort)
+	tconfig.addTypedOption("maxage", "m", optDuration, time.Minute, "Maximum age of rules", dfltMaxage)
+	tconfig.addTypedOption("timeout", "timeout", optDuration, time.Second, "Timeout", dfltTimeout)
+	tconfig.addTypedOption("retries", "retries", optInt, 0, "Number of retries", dfltRetries)
+	tconfig.addTypedOption("certwarn", "certwarn", optInt, 0, "Certificate warning", dfltCertWarn)
+	tconfig.addTypedOption("signwindow", "signwindow", optDuration, time.Second, "Signing window", dfltSignWindow)
+	tconfig.addOption("failopen", "failopen", false, "Remove all rules on exit", "no")
+	tconfig.addOption("acl", "acl", true, "ACL name", dfltACL)
+	tconfig.addOption("tlsmin", "tlsmin", true, "Minimum TLS version", dfltTLSMin)
+	for _, name := range []string{"ratelimit", "sensorrate", "panic"} {
+		tconfig.addTypedOption(name, name, optInt, 0, "Rate limit", "0")
+	}
+
+	// The command line is not parsed, so only the file is read
+	tconfig.args = map[string]string{"cfgpath": path}
+
+	defer func(age uint64, open bool, timeout time.Duration, retries int) {
+		maxruleage, failOpen, restTimeout, restRetries = age, open, timeout, retries
+	}(maxruleage, failOpen, restTimeout, restRetries)
+
+	ioutil.WriteFile(path, []byte("host = http://192.0.2.1\nport = 1000\nmaxage = 30\nfailopen = yes\n"), 0644)
+	current := tconfig.read()
+	if err = applyOptions(current, tconfig.file.sections); err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(path, []byte("host = http://192.0.2.1\nport = 2000\nmaxage = 90\nfailopen = no\n"), 0644)
+	current = reloadConfig(&tconfig, current)
+
+	if maxruleage != 5400 || failOpen || current["port"] != "1000" || current["maxage"] != "90" {
+		t.Errorf("Expected maxage and failopen to change but not port, found %d %v %v", maxruleage, failOpen, current)
+	}
+
+	// Rejected by the option checks, and by applyOptions()
+	for _, bad := range []string{"maxage = 10\nretries = -1\n", "maxage = 10\ntimeout = 0\n"} {
+		ioutil.WriteFile(path, []byte("host = http://192.0.2.1\n"+bad), 0644)
+		if reloaded := reloadConfig(&tconfig, current); !reflect.DeepEqual(reloaded, current) || maxruleage != 5400 {
+			t.Errorf("Expected %q to be rejected, but maxage is %d", bad, maxruleage)
+		}
+	}
+
+	tnsrMutex.Lock()
+	targets = nil
+	tnsrMutex.Unlock()
+}
+
+// Ensure that the earliest expiry time is read from a PEM file containing more than one certificate
+func TestCertExpiry(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pemData []byte
+	expiries := []time.Time{time.Unix(1893456000, 0), time.Unix(1861920000, 0)}
+
+	for idx, notAfter := range expiries {
+		tmpl := x509.Certificate{SerialNumber: big.NewInt(int64(idx + 1)), NotBefore: time.Unix(1546300800, 0), NotAfter: notAfter}
+		der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pemData = append(pemData, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	f, err := ioutil.TempFile("", "tnsrids-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(f.Name())
+	f.Write(pemData)
+	f.Close()
+
+	notAfter, err := certExpiry(f.Name())
+	if err != nil || !notAfter.Equal(expiries[1]) {
+		t.Errorf("Expected expiry %v but got %v (%v)", expiries[1], notAfter, err)
+	}
+}
+
+// Ensure that a certificate which can not be loaded is reported once, and that the expiry of the certificate still
+// in use is reported rather than that of the file
+func TestCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tnsrids-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Write a self signed certificate and its key
+	writePair := func(certFile string, keyFile string, notAfter time.Time) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tmpl := x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now().Add(-time.Hour), NotAfter: notAfter, IsCA: true}
+		der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keyDER, _ := x509.MarshalECPrivateKey(key)
+		ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+		if len(keyFile) > 0 {
+			ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+		}
+	}
+
+	inUse := time.Now().Add(100 * 24 * time.Hour).Truncate(time.Second)
+	writePair(dir+"/ca.crt", "", inUse)
+	writePair(dir+"/tnsr.crt", dir+"/tnsr.key", inUse)
+
+	tgt, err := newTarget("a", map[string]string{"host": "https://192.0.2.1", "acl": dfltACL, "certwarn": "30", "capath": dir + "/ca.crt",
+		"certpath": dir + "/tnsr.crt", "keypath": dir + "/tnsr.key", "clientcert": "yes", "tlsmin": "1.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the certificate but not the key
+	writePair(dir+"/tnsr.crt", "", time.Now().Add(24*time.Hour))
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(dir+"/tnsr.crt", later, later)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	cw := tgt.certWatch()
+	cw.check()
+	cw.check()
+
+	if n := strings.Count(buf.String(), "could not be loaded"); n != 1 {
+		t.Errorf("Expected the reload failure to be logged once, but it was logged %d times", n)
+	}
+
+	if times := cw.expiryTimes(); times["client"] != inUse.Unix() {
+		t.Errorf("Expected the expiry of the certificate in use, %d, but got %d", inUse.Unix(), times["client"])
+	}
+
+	if strings.Contains(buf.String(), "expires in") {
+		t.Errorf("The certificate that is not in use should not be reported: %s", buf.String())
+	}
+}
+
+// Ensure that credentials are read from the authfile, that the environment overrides them for the default target
+// only, and that server-only TLS needs neither a client certificate nor, with ca = system, a CA file
+func TestAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tnsrids-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	authfile := dir + "/auth"
+	ioutil.WriteFile(authfile, []byte("fileuser:file:secret\n"), 0600)
+
+	user, password, err := loadCredentials(authfile, true)
+	if err != nil || user != "fileuser" || password != "file:secret" {
+		t.Errorf("Expected the credentials from the file, but got %s:%s (%v)", user, password, err)
+	}
+
+	ioutil.WriteFile(dir+"/empty", nil, 0600)
+	if _, _, err = loadCredentials(dir+"/empty", true); err == nil {
+		t.Errorf("Expected an error for an empty credentials file")
+	}
+
+	t.Setenv(envUser, "envuser")
+	t.Setenv(envPassword, "envsecret")
+
+	for _, name := range []string{dfltTargetName, "b"} {
+		tgt, err := newTarget(name, map[string]string{"host": "http://192.0.2.1", "acl": dfltACL, "certwarn": "30", "authfile": authfile})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := "fileuser"
+		if name == dfltTargetName {
+			expected = "envuser"
+		}
+
+		if tgt.user != expected {
+			t.Errorf("Expected %s to use the credentials of %s, but got %s", name, expected, tgt.user)
+		}
+	}
+
+	// A CA certificate, without a client certificate or key
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour), IsCA: true}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(dir+"/ca.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+
+	options := map[string]string{"capath": dir + "/ca.crt", "certpath": dir + "/missing.crt", "keypath": dir + "/missing.key",
+		"clientcert": "no", "tlsmin": "1.2"}
+
+	cfg, err := buildTLSConfig(options)
+	if err != nil || len(cfg.Certificates) != 0 || cfg.RootCAs == nil {
+		t.Errorf("Expected the CA and no client certificate, but got %v", err)
+	}
+
+	options["capath"] = caSystem
+	cfg, err = buildTLSConfig(options)
+	if err != nil || cfg.RootCAs != nil {
+		t.Errorf("Expected the system CAs to be used, but got %v", err)
+	}
+
+	if err = (ConfigItem{kind: optCAPath}).check(caSystem); err != nil {
+		t.Errorf("Expected ca = system to be a valid option: %v", err)
+	}
+
+	options["clientcert"] = "yes"
+	if _, err = buildTLSConfig(options); err == nil {
+		t.Errorf("Expected an error for a missing client certificate")
+	}
+}
+
+// A fakeTNSR serves the acl-rules of a single ACL. While down is set every request fails with 503
+type fakeTNSR struct {
+	rules ACLRuleList
+	puts  int
+	down  bool
+}
+
+func (f *fakeTNSR) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(f.rules)
+	case http.MethodPut:
+		var body struct {
+			Rule AAclRule `json:"netgate-acl:acl-rule"`
+		}
+
+		json.NewDecoder(r.Body).Decode(&body)
+		f.rules.AclRule = append(f.rules.AclRule, body.Rule)
+		f.puts++
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		seq := r.URL.Path[strings.LastIndex(r.URL.Path, "=")+1:]
+		for idx, rule := range f.rules.AclRule {
+			if fmt.Sprint(rule.Sequence) == seq {
+				f.rules.AclRule = append(f.rules.AclRule[:idx], f.rules.AclRule[idx+1:]...)
+				break
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Ensure that with maxage 0 only the rules that were given their own expiry time are reaped
+func TestReapExpiry(t *testing.T) {
+	now := time.Now().Unix()
+	fake := fakeTNSR{rules: ACLRuleList{AclRule: []AAclRule{
+		{Sequence: 1, SrcIPPrefix: "192.0.2.1/32", AclRuleDescription: "100, Added by tnsrids"},
+		{Sequence: 2, SrcIPPrefix: "192.0.2.2/32", AclRuleDescription: "100, Added by tnsrids, expires 200"},
+		{Sequence: 3, SrcIPPrefix: "192.0.2.3/32", AclRuleDescription: fmt.Sprintf("%d, Added by tnsrids, expires %d", now, now+60)},
+	}}}
+
+	srv := httptest.NewServer(&fake)
+	defer srv.Close()
+
+	tgt, err := newTarget("a", map[string]string{"host": srv.URL, "acl": dfltACL, "certwarn": "30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(age uint64) { maxruleage = age }(maxruleage)
+	maxruleage = 0
+
+	tnsrMutex.Lock()
+	setTargets([]*Target{tgt})
+	tnsrMutex.Unlock()
+
+	if err = reapACLs(); err != nil {
+		t.Error(err)
+	}
+
+	if len(fake.rules.AclRule) != 2 || fake.rules.AclRule[0].Sequence != 1 || fake.rules.AclRule[1].Sequence != 3 {
+		t.Errorf("Expected only the expired rule to be reaped, but %v remain", fake.rules.AclRule)
+	}
+
+	tnsrMutex.Lock()
+	targets = nil
+	aclcache = ACLRuleList{}
+	tnsrMutex.Unlock()
+}
+
+// Ensure that a block is added to every target, and that a target which fails is retried later without the rule
+// being duplicated on the others
+func TestTargetFanOut(t *testing.T) {
+	var fakes [2]fakeTNSR
+	var list []*Target
+
+	for idx := range fakes {
+		srv := httptest.NewServer(&fakes[idx])
+		defer srv.Close()
+
+		tgt, err := newTarget(string(rune('a'+idx)), map[string]string{"host": srv.URL, "acl": dfltACL, "certwarn": "30"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		list = append(list, tgt)
+	}
+
+	defer func(retries int) { restRetries = retries }(restRetries)
+	restRetries = 0
+
+	tnsrMutex.Lock()
+	setTargets(list)
+	tnsrMutex.Unlock()
+
+	dir, err := ioutil.TempDir("", "tnsrids")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	defer func() { pendingPath = "" }()
+	pendingPath = filepath.Join(dir, "pending.json")
+
+	fakes[1].down = true
+	if err := addRule(context.Background(), "192.0.2.1/32", true, 0, ""); err != nil {
+		t.Errorf("Block should succeed while one target is up: %v", err)
+	}
+
+	if names := pendingTargets(); len(names) != 1 || names[0] != "b" {
+		t.Errorf("Expected the block to be waiting for b, but found %v", names)
+	}
+
+	// The block waiting for the second target must survive a restart
+	tnsrMutex.Lock()
+	list[1].pending = nil
+	loadPending()
+	tnsrMutex.Unlock()
+
+	if len(list[1].pending) != 1 || list[1].pending[0].Host != "192.0.2.1/32" {
+		t.Errorf("Expected the pending block to be restored, but found %v", list[1].pending)
+	}
+
+	fakes[1].down = false
+	retryPendingBlocks()
+
+	if fakes[0].puts != 1 || fakes[1].puts != 1 || len(list[1].pending) != 0 {
+		t.Errorf("Expected one rule on each target, found %d and %d with %d pending", fakes[0].puts, fakes[1].puts, len(list[1].pending))
+	}
+
+	if err := addRule(context.Background(), "192.0.2.1/32", true, 0, ""); err != errDuplicateRule {
+		t.Errorf("Expected a duplicate rule error, but got %v", err)
+	}
+
+	tnsrMutex.Lock()
+	targets = nil
+	aclcache = ACLRuleList{}
+	tnsrMutex.Unlock()
+}
+
+// Ensure that /readyz is only 200 while the listener runs and every target has been reached recently, and that
+// /healthz is always 200
+func TestHealth(t *testing.T) {
+	fake := fakeTNSR{down: true}
+	srv := httptest.NewServer(&fake)
+	defer srv.Close()
+
+	tgt, err := newTarget("a", map[string]string{"host": srv.URL, "acl": dfltACL, "certwarn": "30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tnsrMutex.Lock()
+	setTargets([]*Target{tgt})
+	tnsrMutex.Unlock()
+
+	defer health.setListening(false)
+
+	check := func(handler http.HandlerFunc, status int, problem string) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/", nil))
+
+		var hs HealthStatus
+		json.Unmarshal(rec.Body.Bytes(), &hs)
+
+		if rec.Code != status || (len(problem) > 0) != (len(hs.Problems) > 0) || !strings.Contains(strings.Join(hs.Problems, "\n"), problem) {
+			t.Errorf("Expected %d with problem \"%s\" but got %d with %v", status, problem, rec.Code, hs.Problems)
+		}
+	}
+
+	health.setListening(true)
+	atomic.StoreInt64(&tgt.lastREST, time.Now().Unix())
+	check(readyzHandler, http.StatusOK, "")
+
+	atomic.StoreInt64(&tgt.lastREST, time.Now().Unix()-readyProbeAge-60)
+	check(readyzHandler, http.StatusServiceUnavailable, "not reachable on a")
+	check(healthzHandler, http.StatusOK, "not reachable on a")
+
+	atomic.StoreInt64(&tgt.lastREST, time.Now().Unix())
+	health.setListening(false)
+	check(readyzHandler, http.StatusServiceUnavailable, "listener is not running")
+
+	tnsrMutex.Lock()
+	targets = nil
+	aclcache = ACLRuleList{}
+	tnsrMutex.Unlock()
+}
+
+// Ensure that the API maps each kind of failure to its status, refuses unsupported methods and only listens on a
+// loopback address unless told otherwise
+func TestAPI(t *testing.T) {
+	var fake fakeTNSR
+	tnsr := httptest.NewServer(&fake)
+	defer tnsr.Close()
+
+	tgt, err := newTarget("a", map[string]string{"host": tnsr.URL, "acl": dfltACL, "certwarn": "30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(retries int) { restRetries = retries }(restRetries)
+	restRetries = 0
+
+	tnsrMutex.Lock()
+	setTargets([]*Target{tgt})
+	tnsrMutex.Unlock()
+
+	srv := httptest.NewServer(apiHandler())
+	defer srv.Close()
+
+	call := func(method string, path string, body string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+		return resp
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"POST", "/api/v1/rules", `{"prefix": "not an address"}`, http.StatusBadRequest},
+		{"POST", "/api/v1/rules", `{"prefix": "192.0.2.1"}`, http.StatusCreated},
+		{"POST", "/api/v1/rules", `{"prefix": "192.0.2.1/32"}`, http.StatusConflict},
+		{"DELETE", "/api/v1/rules/192.0.2.99", "", http.StatusNotFound},
+		{"DELETE", "/api/v1/rules/not-an-address", "", http.StatusBadRequest},
+		{"GET", "/api/v1/rules?managed=true", "", http.StatusOK},
+		{"GET", "/api/v1/rules?managed=1", "", http.StatusOK},
+		{"GET", "/api/v1/rules?managed=maybe", "", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		if resp := call(test.method, test.path, test.body); resp.StatusCode != test.status {
+			t.Errorf("Expected %d for %s %s %s but got %d", test.status, test.method, test.path, test.body, resp.StatusCode)
+		}
+	}
+
+	if resp := call("PUT", "/api/v1/rules", ""); resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, POST" {
+		t.Errorf("Expected PUT to be refused, but got %d allowing %s", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+
+	fake.down = true
+	if resp := call("POST", "/api/v1/rules", `{"prefix": "192.0.2.2"}`); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 502 while TNSR is failing but got %d", resp.StatusCode)
+	}
+
+	fake.down = false
+	lease = &Lease{}
+	resp := call("POST", "/api/v1/rules", `{"prefix": "192.0.2.3"}`)
+	lease = nil
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 from the standby but got %d", resp.StatusCode)
+	}
+
+	for addr, ok := range map[string]bool{"127.0.0.1:8080": true, "[::1]:8080": true, "localhost:8080": true, ":8080": false, "192.0.2.1:8080": false} {
+		if err := checkAPIAddr(addr, false); (err == nil) != ok {
+			t.Errorf("Unexpected result for %s: %v", addr, err)
+		}
+	}
+
+	if err := checkAPIAddr("192.0.2.1:8080", true); err != nil {
+		t.Errorf("Expected apiremote to permit any address: %v", err)
+	}
+
+	tnsrMutex.Lock()
+	targets = nil
+	aclcache = ACLRuleList{}
+	tnsrMutex.Unlock()
+}
+
+// Ensure that shutdown does not finish while the block worker is still waiting to add a rule, even once the drain
+// deadline has passed, and that the abandoned block is not added afterwards
+func TestShutdownDrain(t *testing.T) {
+	var fake fakeTNSR
+	srv := httptest.NewServer(&fake)
+	defer srv.Close()
+
+	tgt, err := newTarget("a", map[string]string{"host": srv.URL, "acl": dfltACL, "certwarn": "30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(timeout time.Duration) { restTimeout = timeout }(restTimeout)
+	restTimeout = 5 * time.Second
+
+	tnsrMutex.Lock()
+	setTargets([]*Target{tgt})
+
+	// The worker has to wait for the lock, as it would behind a reap
+	hostQueue <- "192.0.2.1/32"
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		tnsrMutex.Unlock()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	startServer(ctx, "0", autoDecoder{}, 50*time.Millisecond)
+
+	if time.Since(start) < 300*time.Millisecond {
+		t.Errorf("Shutdown finished after %v, while the worker was still running", time.Since(start))
+	}
+
+	if fake.puts != 0 || len(hostQueue) != 0 {
+		t.Errorf("Expected the block to be abandoned, but found %d rules and %d queued", fake.puts, len(hostQueue))
+	}
+
+	tnsrMutex.Lock()
+	targets = nil
+	aclcache = ACLRuleList{}
+	tnsrMutex.Unlock()
+}
+
+// Ensure that on a fail-open exit only the rules added by tnsrids are removed, and that a target that can not be
+// reached is reported
+func TestFailOpen(t *testing.T) {
+	var fakes [2]fakeTNSR
+	var list []*Target
+
+	fakes[0].rules.AclRule = []AAclRule{
+		{Sequence: 1, SrcIPPrefix: "192.0.2.1/32", AclRuleDescription: "100, Added by tnsrids"},
+		{Sequence: 2, SrcIPPrefix: "192.0.2.2/32", AclRuleDescription: "Blocked by hand"},
+		{Sequence: 3, SrcIPPrefix: "192.0.2.3/32", AclRuleDescription: "100, Added by tnsrids (manual), expires 200"},
+		{Sequence: 2147483646, SrcIPPrefix: "0.0.0.0/0", Action: "permit", AclRuleDescription: "Default permit"},
+	}
+
+	for idx := range fakes {
+		srv := httptest.NewServer(&fakes[idx])
+		defer srv.Close()
+
+		tgt, err := newTarget(string(rune('a'+idx)), map[string]string{"host": srv.URL, "acl": dfltACL, "certwarn": "30"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		list = append(list, tgt)
+	}
+
+	defer func(retries int) { restRetries = retries }(restRetries)
+	restRetries = 0
+
+	tnsrMutex.Lock()
+	setTargets(list)
+	tnsrMutex.Unlock()
+
+	fakes[1].down = true
+	err := removeManagedRules()
+	if err == nil || !strings.HasPrefix(err.Error(), "b: ") {
+		t.Errorf("Expected an error for the unreachable target, but got %v", err)
+	}
+
+	var remaining []uint64
+	for _, rule := range fakes[0].rules.AclRule {
+		remaining = append(remaining, rule.Sequence)
+	}
+
+	if !reflect.DeepEqual(remaining, []uint64{2, 2147483646}) {
+		t.Errorf("Expected only the rules not added by tnsrids to remain, but found %v", remaining)
+	}
+
+	tnsrMutex.Lock()
+	targets = nil
+	aclcache = ACLRuleList{}
+	tnsrMutex.Unlock()
+}
+
+// Ensure that only one of two instances holds the lease, and that the standby takes over when the lease is released
+func TestLease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tnsrids-lease")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	var pair [2]*Lease
+	for idx := range pair {
+		pair[idx], err = newLease(dir+"/lease", 30*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pair[idx].id += string(rune('a' + idx))
+	}
+
+	renew := func(l *Lease) {
+		if l.renew() {
+			l.takeOver()
+		}
+	}
+
+	renew(pair[0])
+	renew(pair[1])
+
+	if pair[0].leader != 1 || pair[1].leader != 0 {
+		t.Errorf("Expected the first instance to be leader, found %d and %d", pair[0].leader, pair[1].leader)
+	}
+
+	pair[0].release()
+
+	renew(pair[1])
+	renew(pair[0])
+
+	if pair[0].leader != 0 || pair[1].leader != 1 {
+		t.Errorf("Expected the standby to take over, found %d and %d", pair[0].leader, pair[1].leader)
+	}
+
+	// A leader whose renewals stall must stop acting as leader before the other instance can take over
+	defer func() { lease = nil }()
+	lease = pair[1]
+
+	if !isLeader() {
+		t.Error("Expected to be leader after renewing the lease")
+	}
+
+	pair[1].renewed -= int64(pair[1].ttl)
+	if isLeader() {
+		t.Error("Expected the leadership to end when the lease was not renewed")
+	}
+}
+
+// Ensure that Suricata EVE alerts are decoded, with or without a syslog header, and that other events are not blocked
+func TestParseEVE(t *testing.T) {
+	var tests = []struct {
+		msg      string
+		attacker string
+		sid      uint64
+	}{
+		{`{"timestamp":"2019-05-01T10:00:00.000000+0000","event_type":"alert","src_ip":"203.0.113.9","src_port":4444,"dest_ip":"192.0.2.10","dest_port":22,"proto":"TCP","direction":"to_server","alert":{"action":"allowed","gid":1,"signature_id":2001219,"rev":20,"signature":"ET SCAN Potential SSH Scan","severity":2}}`, "203.0.113.9", 2001219},
+		{`<134>May  1 10:00:00 sensor suricata[812]: {"event_type":"alert","src_ip":"2001:db8::5","dest_ip":"2001:db8::1","alert":{"signature_id":7,"signature":"Test","severity":1,"source":{"ip":"2001:db8::1"}}}`, "2001:db8::1", 7},
+		{`{"event_type":"alert","src_ip":"192.0.2.10","src_port":80,"dest_ip":"203.0.113.9","dest_port":51000,"direction":"to_client","alert":{"signature_id":8,"signature":"Test","severity":1}}`, "203.0.113.9", 8},
+		{`{"event_type":"flow","src_ip":"203.0.113.9","dest_ip":"192.0.2.10"}`, "", 0},
+	}
+
+	for _, test := range tests {
+		a, ok := parseEVE(test.msg)
+		if !ok || a.Format != fmtEVE || a.Attacker != test.attacker || a.SID != test.sid {
+			t.Errorf("Unexpected result %v (%v) for %s", a, ok, test.msg)
+		}
+	}
+
+	if _, ok := parseEVE("May  1 10:00:00 snort: [1:1000001:1] Test {TCP} 203.0.113.9:80 -> 192.0.2.10:1234"); ok {
+		t.Errorf("Snort syslog alert should not be decoded as EVE")
+	}
+}
+
+// Ensure that Snort 3 alert_json and Snort 2 alert_syslog messages are decoded into the same alert
+func TestParseSnort(t *testing.T) {
+	expected := Alert{Format: fmtSnort3, Attacker: "203.0.113.9", Src: "203.0.113.9", Dst: "192.0.2.10", Direction: "to_server",
+		GID: 1, SID: 1000001, Signature: "Port scan", Severity: 2}
+
+	a, ok := parseSnort3JSON(`{ "timestamp" : "05/01-10:00:00.000000", "rule" : "1:1000001:1", "msg" : "Port scan", "priority" : 2, "dir" : "C2S", "src_ap" : "203.0.113.9:4444", "dst_ap" : "192.0.2.10:22" }`)
+	if !ok || !reflect.DeepEqual(a, expected) {
+		t.Errorf("Expected %v but got %v", expected, a)
+	}
+
+	dec, _ := newDecoder(fmtAuto)
+	a, _ = dec.Decode(`May  1 10:00:00 sensor snort[812]: [1:1000001:1] Port scan [Classification: Attempted Information Leak] [Priority: 2] {TCP} 203.0.113.9:4444 -> 192.0.2.10:22`)
+	expected.Format, expected.Direction = fmtSyslog, ""
+	if !reflect.DeepEqual(a, expected) {
+		t.Errorf("Expected %v but got %v", expected, a)
+	}
+
+	a, ok = parseSnort3JSON(`{ "rule" : "1:1000002:1", "dir" : "S2C", "src_ap" : "192.0.2.10:80", "dst_ap" : "203.0.113.9:51000" }`)
+	if !ok || a.Attacker != "203.0.113.9" {
+		t.Errorf("Expected the client to be blocked for a server to client alert, but got %v", a)
+	}
+
+	a, ok = parseSnort3JSON(`{ "src_addr" : "2001:db8::5", "dst_addr" : "2001:db8::1", "gid" : 116, "sid" : 414 }`)
+	if !ok || a.Attacker != "2001:db8::5" || a.GID != 116 || a.SID != 414 {
+		t.Errorf("Unexpected result %v for IPv6 alert", a)
+	}
+
+	if apAddr("[2001:db8::5]:443", true) != "2001:db8::5" || apAddr("192.0.2.10", false) != "192.0.2.10" {
+		t.Errorf("Unable to split an IPv6 address and port")
+	}
+
+	// An unbracketed IPv6 address is itself a valid address with the port taken as its last group
+	if apAddr("2001:db8::5:4444", true) != "2001:db8::5" || apAddr("2001:db8::5:4444", false) != "2001:db8::5:4444" || apAddr("2001:db8::5", true) != "" {
+		t.Errorf("Unbracketed IPv6 address and port split incorrectly")
+	}
+}
+
+// Ensure that a followed file is read across rotation and truncation, and that a restart resumes from the saved offset
+func TestFollow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tnsrids-follow")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := dir + "/alert"
+	hf := make(chan string, 10)
+	alert := func(n int) string {
+		return "05/01-10:00:00.000000  [**] [1:1000001:1] Test [**] [Priority: 2] {TCP} 203.0.113." + string(rune('0'+n)) + ":4444 -> 192.0.2.10:22\n"
+	}
+
+	expect := func(hosts ...string) {
+		for _, host := range hosts {
+			select {
+			case got := <-hf:
+				if got != host {
+					t.Errorf("Expected %s but got %s", host, got)
+				}
+			default:
+				t.Errorf("Expected %s but nothing was queued", host)
+			}
+		}
+
+		if len(hf) > 0 {
+			t.Errorf("Unexpected hosts queued: %d", len(hf))
+		}
+	}
+
+	ioutil.WriteFile(path, []byte(alert(1)), 0644)
+
+	// The existing alert is skipped at start-up, and an incomplete line is held back
+	f := &Follower{path: path, dec: autoDecoder{}}
+	f.poll(nil, hf)
+	fd, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	fd.WriteString(alert(2) + alert(3)[:20])
+	f.poll(nil, hf)
+	expect("203.0.113.2/32")
+
+	// A restart resumes with the incomplete line
+	saved := f.state()
+	f = &Follower{path: path, dec: autoDecoder{}}
+	f.poll(&saved, hf)
+	fd.WriteString(alert(3)[20:])
+	fd.Close()
+	f.poll(nil, hf)
+	expect("203.0.113.3/32")
+
+	// Rotation: the rest of the old file is read before the new one
+	fd, _ = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	fd.WriteString(alert(4))
+	fd.Close()
+	os.Rename(path, path+".1")
+	ioutil.WriteFile(path, []byte(alert(5)), 0644)
+	f.poll(nil, hf)
+	expect("203.0.113.4/32", "203.0.113.5/32")
+
+	// Truncation
+	ioutil.WriteFile(path, []byte(alert(6)), 0644)
+	f.poll(nil, hf)
+	expect("203.0.113.6/32")
+
+	// The whole of an over-long line is discarded, including the end that follows the limit
+	fd, _ = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	fd.WriteString(strings.Repeat("x", maxLineLen+followReadSize) + " from 203.0.113.7\n" + alert(8))
+	fd.Close()
+	f.poll(nil, hf)
+	expect("203.0.113.8/32")
+}
+
+// Ensure that unified2 events are read across records and files, and that a restart resumes from the waldo
+func TestUnified2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tnsrids-u2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	record := func(rtype uint32, body []byte) []byte {
+		rec := make([]byte, 8, 8+len(body))
+		binary.BigEndian.PutUint32(rec[0:], rtype)
+		binary.BigEndian.PutUint32(rec[4:], uint32(len(body)))
+		return append(rec, body...)
+	}
+
+	event := func(rtype uint32, src string, dst string) []byte {
+		ip := net.ParseIP(src)
+		addrs := append([]byte(ip.To4()), net.ParseIP(dst).To4()...)
+		size := 60
+		if ip.To4() == nil {
+			addrs = append([]byte(ip.To16()), net.ParseIP(dst).To16()...)
+			size = 84
+		}
+
+		body := make([]byte, size)
+		binary.BigEndian.PutUint32(body[16:], 1000001) // sid
+		binary.BigEndian.PutUint32(body[20:], 1)       // gid
+		binary.BigEndian.PutUint32(body[32:], 2)       // priority
+		copy(body[36:], addrs)
+		return record(rtype, body)
+	}
+
+	path := dir + "/merged.log.1000"
+	data := append(event(u2EventV2IPv4, "203.0.113.1", "192.0.2.10"), record(2, make([]byte, 40))...)
+	ioutil.WriteFile(path, data, 0644)
+
+	// Without a waldo, existing events are skipped
+	hf := make(chan string, 10)
+	u := newU2Reader(dir, "merged.log", "")
+	u.poll(hf)
+	if len(hf) != 0 {
+		t.Fatalf("Expected existing events to be skipped, got %d", len(hf))
+	}
+
+	// A partial record is held back until it is complete
+	rec := event(u2EventV2IPv6, "2001:db8::5", "2001:db8::1")
+	fd, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	fd.Write(rec[:30])
+	if u.poll(hf) || len(hf) != 0 {
+		t.Fatal("Partial record should not be read")
+	}
+
+	fd.Write(rec[30:])
+	fd.Close()
+	u.poll(hf)
+	if got := <-hf; got != "2001:db8::5/128" {
+		t.Errorf("Expected 2001:db8::5/128 but got %s", got)
+	}
+
+	err = u.saveWaldo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A restart resumes from the waldo, and moves on to the next file
+	ioutil.WriteFile(dir+"/merged.log.2000", event(u2EventIPv4, "203.0.113.2", "192.0.2.10"), 0644)
+	u = newU2Reader(dir, "merged.log", "")
+	u.poll(hf)
+	u.poll(hf)
+	if len(hf) != 1 {
+		t.Fatalf("Expected 1 host queued but got %d", len(hf))
+	}
+
+	if got := <-hf; got != "203.0.113.2/32" {
+		t.Errorf("Expected 203.0.113.2/32 but got %s", got)
+	}
+
+	// If the current file is deleted, reading carries on with the next one
+	os.Remove(dir + "/merged.log.2000")
+	ioutil.WriteFile(dir+"/merged.log.3000", event(u2EventIPv4, "203.0.113.3", "192.0.2.10"), 0644)
+	u.poll(hf)
+	u.poll(hf)
+	if len(hf) != 1 || <-hf != "203.0.113.3/32" {
+		t.Errorf("Expected to move on to the next file after the current one was deleted")
+	}
+
+	// If the file the waldo names has been deleted, reading starts with the file after it, not with an older one
+	ioutil.WriteFile(dir+"/merged.log.waldo", []byte(`{"file":"merged.log.2000","offset":12}`), 0644)
+	u = newU2Reader(dir, "merged.log", "")
+	u.poll(hf)
+	if len(hf) != 1 || <-hf != "203.0.113.3/32" {
+		t.Errorf("Expected to resume with the file after the deleted waldo file")
+	}
+}
+
+// Ensure that the format of each message is detected, and that a fixed format rejects other messages
+func TestDecoders(t *testing.T) {
+	tests := []struct {
+		msg    string
+		format string
+	}{
+		{`05/01-10:00:00.000000  [**] [1:1000001:1] Test [**] [Priority: 2] {TCP} 203.0.113.9:4444 -> 192.0.2.10:22`, fmtFast},
+		{`May  1 10:00:00 sensor snort[812]: [1:1000001:1] Test [Priority: 2] {TCP} 203.0.113.9:4444 -> 192.0.2.10:22`, fmtSyslog},
+		{`{"event_type":"alert","src_ip":"203.0.113.9","dest_ip":"192.0.2.10","alert":{"signature_id":7}}`, fmtEVE},
+		{`{ "src_addr" : "203.0.113.9", "dst_addr" : "192.0.2.10", "rule" : "1:7:1" }`, fmtSnort3},
+		{`Failed password for root from 203.0.113.9 port 4444`, fmtGeneric},
+	}
+
+	auto, _ := newDecoder("")
+	syslog, _ := newDecoder(fmtSyslog)
+
+	for _, test := range tests {
+		a, ok := auto.Decode(test.msg)
+		if !ok || a.Format != test.format || a.Attacker != "203.0.113.9" {
+			t.Errorf("Expected %s but got %v for %s", test.format, a, test.msg)
+		}
+
+		_, ok = syslog.Decode(test.msg)
+		if ok != (test.format == fmtSyslog || test.format == fmtFast) {
+			t.Errorf("Syslog decoder returned %v for %s", ok, test.msg)
+		}
+	}
+
+	if _, err := newDecoder("cef"); err == nil {
+		t.Errorf("Unknown format should be rejected")
+	}
+}
+
+// Ensure that user patterns are validated, tried in order and fill in the alert
+func TestPatterns(t *testing.T) {
+	section := func(src string) *yaml.Node {
+		var node yaml.Node
+		err := yaml.Unmarshal([]byte(src), &node)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return node.Content[0]
+	}
+
+	for _, bad := range []string{
+		`[{regex: 'from (\S+)'}]`,
+		`[{regex: 'from (?P<attacker>\S+) (?P<port>\d+)'}]`,
+		`[{regex: '(?P<attacker>'}]`,
+		`[{regex: '(?P<attacker>\S+)', colour: red}]`,
+	} {
+		if _, err := compilePatterns(section(bad)); err == nil {
+			t.Errorf("Expected an error for %s", bad)
+		}
+	}
+
+	list, err := compilePatterns(section(`
+- name: ssh
+  regex: 'sshguard\[\d+\]: Attack from "(?P<attacker>[0-9a-fA-F.:]+)"'
+  severity: 2
+- name: web
+  regex: 'scan: (?P<signature>[^:]+): (?P<attacker>\S+) -> (?P<victim>\S+) sev=(?P<severity>\d)'
+- name: catchall
+  regex: 'from (?P<attacker>\S+)'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setPatterns(list)
+	defer setPatterns(nil)
+
+	tests := []struct {
+		msg      string
+		expected Alert
+	}{
+		{`sshguard[99]: Attack from "2001:db8::5" on service SSH`, Alert{Format: fmtRegex, Attacker: "2001:db8::5", Src: "2001:db8::5", Signature: "ssh", Severity: 2}},
+		{`scan: Nikto probe: 203.0.113.9 -> 192.0.2.10 sev=1`, Alert{Format: fmtRegex, Attacker: "203.0.113.9", Src: "203.0.113.9", Dst: "192.0.2.10", Signature: "Nikto probe", Severity: 1}},
+		{`scan: Nikto probe: www.example.com -> 192.0.2.10 sev=1 from 203.0.113.7`, Alert{Format: fmtRegex, Attacker: "203.0.113.7", Src: "203.0.113.7", Signature: "catchall"}},
+	}
+
+	dec, _ := newDecoder(fmtAuto)
+	for _, test := range tests {
+		a, _ := dec.Decode(test.msg)
+		if !reflect.DeepEqual(a, test.expected) {
+			t.Errorf("Expected %v but got %v", test.expected, a)
+		}
+	}
+}
+
+// Ensure that only permitted senders are accepted, and that each is identified
+func TestSensors(t *testing.T) {
+	var node yaml.Node
+	err := yaml.Unmarshal([]byte(`
+- name: dmz
+  addr: [192.0.2.0/28, "2001:db8::10"]
+- name: core
+  addr: 192.0.2.0/24
+`), &node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := buildSensors("198.51.100.7", node.Content[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setSensors(list)
+	defer setSensors(nil)
+
+	tests := []struct {
+		addr   string
+		sensor string
+		ok     bool
+	}{
+		{"198.51.100.7", "198.51.100.7", true},
+		{"192.0.2.5", "dmz", true},
+		{"192.0.2.200", "core", true},
+		{"2001:db8::10", "dmz", true},
+		{"203.0.113.9", "", false},
+	}
+
+	for _, test := range tests {
+		sensor, ok := identifySensor(net.ParseIP(test.addr))
+		if sensor != test.sensor || ok != test.ok {
+			t.Errorf("Expected %s (%v) for %s but got %s (%v)", test.sensor, test.ok, test.addr, sensor, ok)
+		}
+	}
+
+	// The sensor is queued with the host
+	hf := make(chan string, 1)
+	parseAlerts("[1:1:1] Test {TCP} 203.0.113.9:4444 -> 192.0.2.10:22", "dmz", autoDecoder{}, hf)
+	if got := <-hf; got != "203.0.113.9/32 dmz" {
+		t.Errorf("Expected the host and sensor but got %s", got)
+	}
+
+	if _, err := buildSensors("", node.Content[0].Content[0]); err == nil {
+		t.Errorf("Expected an error for a sensors section that is not a list")
+	}
+}
+
+// Ensure that signed alerts are verified, and that forged, stale and replayed alerts are rejected
+func TestSignedAlerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tnsrids-sign")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	keyfile := dir + "/dmz.key"
+	ioutil.WriteFile(keyfile, []byte("0123456789abcdef0123\n"), 0600)
+
+	var node yaml.Node
+	yaml.Unmarshal([]byte("[{name: dmz, keyfile: "+keyfile+"}]"), &node)
+	list, err := buildSensors("", node.Content[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setSensors(list)
+	setSigning(true, 30*time.Second)
+	defer setSensors(nil)
+	defer setSigning(false, 30*time.Second)
+
+	key := []byte("0123456789abcdef0123")
+	addr := net.ParseIP("203.0.113.50")
+	alert := "[1:1:1] Test {TCP} 203.0.113.9:4444 -> 192.0.2.10:22"
+
+	msg, _ := signAlert(key, "dmz", alert, time.Now())
+	sensor, payload, err := authenticate(msg, addr)
+	if err != nil || sensor != "dmz" || payload != alert {
+		t.Fatalf("Signed alert rejected: %v", err)
+	}
+
+	if _, _, err = authenticate(msg, addr); err != errReplayed {
+		t.Errorf("Expected a replayed alert to be rejected but got %v", err)
+	}
+
+	msg, _ = signAlert(key, "dmz", alert, time.Now())
+	if _, _, err = authenticate(strings.Replace(msg, "203.0.113.9", "192.0.2.1", 1), addr); err != errBadSignature {
+		t.Errorf("Expected a forged alert to be rejected but got %v", err)
+	}
+
+	msg, _ = signAlert(key, "dmz", alert, time.Now().Add(-time.Minute))
+	if _, _, err = authenticate(msg, addr); err == nil {
+		t.Errorf("Expected a stale alert to be rejected")
+	}
+
+	msg, _ = signAlert([]byte("another key of sufficient length"), "dmz", alert, time.Now())
+	if _, _, err = authenticate(msg, addr); err != errBadSignature {
+		t.Errorf("Expected an alert signed with the wrong key to be rejected but got %v", err)
+	}
+
+	if _, _, err = authenticate(alert, addr); err != errUnsigned {
+		t.Errorf("Expected an unsigned alert to be rejected but got %v", err)
+	}
+
+	// Even when signing is optional, an unsigned alert from the address of a sensor that has a key is rejected
+	setSigning(false, 30*time.Second)
+	list[0].nets, _ = parseCIDRList("203.0.113.50")
+
+	if _, _, err = authenticate(alert, addr); err != errUnsigned {
+		t.Errorf("Expected an unsigned alert from a keyed sensor to be rejected but got %v", err)
+	}
+
+	list[0].nets = nil
+	setSigning(true, 30*time.Second)
+
+	// The forwarder's alerts are accepted
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	err = forwardAlerts(strings.NewReader(alert+"\n"), conn.LocalAddr().String(), "dmz", keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, maxDatagram)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, payload, err = authenticate(string(buf[:n]), addr); err != nil || payload != alert {
+		t.Errorf("Forwarded alert rejected: %v", err)
+	}
+}
+
+// Ensure that new blocks are limited globally and per sensor, and that the panic threshold stops blocking
+func TestRateLimits(t *testing.T) {
+	var node yaml.Node
+	yaml.Unmarshal([]byte("[{name: core, addr: 192.0.2.1, rate: 0}]"), &node)
+	list, err := buildSensors("", node.Content[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setSensors(list)
+	defer setSensors(nil)
+
+	l := RateLimiter{bySensor: make(map[string][]time.Time)}
+	l.set(4, 2, 6)
+
+	tests := []struct {
+		sensor  string
+		allowed bool
+	}{
+		{"198.51.100.1", true},
+		{"198.51.100.2", true},
+		{"198.51.100.3", false}, // Unlisted senders share the sensor limit
+		{"core", true},          // No limit for this sensor
+		{"core", true},
+		{"core", false}, // Global limit
+		{"", false},     // Panic
+	}
+
+	for idx, test := range tests {
+		host := fmt.Sprintf("203.0.113.%d/32", idx)
+		if l.allow(host, test.sensor) != test.allowed {
+			t.Errorf("Expected %v for block %d from %s", test.allowed, idx, test.sensor)
+		}
+	}
+
+	reasons := []string{suppressSensor, suppressGlobal, suppressPanic}
+	for idx, sb := range l.list() {
+		if idx >= len(reasons) || sb.Reason != reasons[idx] {
+			t.Errorf("Unexpected suppressed block %v", sb)
+		}
+	}
+
+	if !l.inPanic() {
+		t.Fatal("Expected automatic blocking to be stopped")
+	}
+
+	l.resume("test")
+	l.set(0, 0, 0)
+	if l.inPanic() || !l.allow("203.0.113.100/32", "dmz") {
+		t.Errorf("Expected automatic blocking to resume")
+	}
+}
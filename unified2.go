@@ -0,0 +1,345 @@
+// unified2.go reads the event records from the unified2 files that Snort 2 writes to its log directory. Unlike the
+// text formats, the records carry the exact addresses (including IPv6) and rule IDs. The position reached is saved
+// in a "waldo" file, as barnyard2 does, so that a restart carries on from the same record
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const fmtUnified2 = "unified2"
+const dfltU2Base = "merged.log" // Matches the unified2 output line in the sample snort.conf
+const u2Poll = time.Second      // How often the spool directory is checked for new records
+const u2HeaderLen = 8           // Record type and length, both big-endian uint32
+const u2MaxRecord = 1024 * 1024 // Larger records mean the file is corrupt
+
+// unified2 record types that carry events. Packet and extra data records are skipped
+const (
+	u2EventIPv4   = 7   // Unified2IDSEvent_legacy
+	u2EventIPv6   = 72  // Unified2IDSEventIPv6_legacy
+	u2EventV2IPv4 = 104 // Unified2IDSEvent (adds MPLS label and VLAN ID)
+	u2EventV2IPv6 = 105 // Unified2IDSEventIPv6
+)
+
+// Offsets of the event fields. The IPv6 records differ only in the size of the addresses
+const (
+	u2OffSID      = 16
+	u2OffGID      = 20
+	u2OffPriority = 32
+	u2OffAddrs    = 36
+)
+
+// A Waldo records the file and offset of the next record to be read
+type Waldo struct {
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+}
+
+// A U2Reader follows the unified2 files in a directory
+type U2Reader struct {
+	dir       string
+	base      string // Files are named base or base.<timestamp>
+	waldoPath string
+	waldo     Waldo
+	file      *os.File
+}
+
+// Create a reader for the unified2 files named base in dir. If waldoPath is empty the bookmark is kept in dir
+func newU2Reader(dir string, base string, waldoPath string) *U2Reader {
+	if len(waldoPath) == 0 {
+		waldoPath = filepath.Join(dir, base+".waldo")
+	}
+
+	return &U2Reader{dir: dir, base: base, waldoPath: waldoPath}
+}
+
+// Return the timestamp in the name of a unified2 file, or -1 for the file named base. ok is false for other files
+func (u *U2Reader) stamp(name string) (ts int64, ok bool) {
+	if name == u.base {
+		return -1, true
+	}
+
+	if !strings.HasPrefix(name, u.base+".") {
+		return 0, false
+	}
+
+	ts, err := strconv.ParseInt(strings.TrimPrefix(name, u.base+"."), 10, 64)
+	return ts, err == nil
+}
+
+// Return the unified2 files in the directory, oldest first
+func (u *U2Reader) files() []string {
+	var stamps []int64
+
+	entries, err := ioutil.ReadDir(u.dir)
+	if err != nil {
+		return nil
+	}
+
+	for _, e := range entries {
+		if ts, ok := u.stamp(e.Name()); ok {
+			stamps = append(stamps, ts)
+		}
+	}
+
+	sort.Slice(stamps, func(i, j int) bool { return stamps[i] < stamps[j] })
+
+	files := make([]string, 0, len(stamps))
+	for _, ts := range stamps {
+		if ts < 0 {
+			files = append(files, u.base)
+		} else {
+			files = append(files, fmt.Sprintf("%s.%d", u.base, ts))
+		}
+	}
+
+	return files
+}
+
+// Return the unified2 files that are newer than the named file, oldest first. The named file need not still exist
+func (u *U2Reader) newer(name string) []string {
+	var files []string
+
+	current, _ := u.stamp(name)
+	for _, f := range u.files() {
+		if ts, _ := u.stamp(f); ts > current {
+			files = append(files, f)
+		}
+	}
+
+	return files
+}
+
+// Open the file the waldo points to, or if it has gone the oldest file after it. Without a waldo reading starts at
+// the end of the newest file, so that old events are not acted on again
+func (u *U2Reader) start() {
+	files := u.files()
+	if len(files) == 0 {
+		return
+	}
+
+	data, err := ioutil.ReadFile(u.waldoPath)
+	if err == nil {
+		var w Waldo
+		if json.Unmarshal(data, &w) == nil && len(w.File) > 0 {
+			for _, f := range files {
+				if f == w.File {
+					u.open(w.File, w.Offset)
+					return
+				}
+			}
+
+			// Files are only looked for after the one the waldo names
+			u.waldo = w
+			u.next()
+			return
+		}
+	}
+
+	newest := files[len(files)-1]
+	if info, err := os.Stat(filepath.Join(u.dir, newest)); err == nil {
+		u.open(newest, info.Size())
+	}
+}
+
+// Open a unified2 file and position the reader at offset, closing the current file. Returns false if the file can
+// not be opened, in which case the current file is kept
+func (u *U2Reader) open(name string, offset int64) bool {
+	file, err := os.Open(filepath.Join(u.dir, name))
+	if err != nil {
+		log.Printf("ERROR: Unable to open unified2 file: %v", err)
+		return false
+	}
+
+	if u.file != nil {
+		u.file.Close()
+	}
+
+	u.file = file
+	u.waldo = Waldo{File: name, Offset: offset}
+	log.Printf("INFO: Reading unified2 file %s from offset %d", name, offset)
+	return true
+}
+
+// Move on to the oldest file after the current one that can be opened. Returns false if there is none
+func (u *U2Reader) next() bool {
+	for _, f := range u.newer(u.waldo.File) {
+		if u.open(f, 0) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Read the complete records that have been written since the last poll. Returns true if the position changed
+func (u *U2Reader) read(hf chan<- string) bool {
+	header := make([]byte, u2HeaderLen)
+	start := u.waldo.Offset
+
+	for {
+		_, err := u.file.ReadAt(header, u.waldo.Offset)
+		if err != nil {
+			break
+		}
+
+		rtype := binary.BigEndian.Uint32(header[0:4])
+		length := binary.BigEndian.Uint32(header[4:8])
+		if length > u2MaxRecord {
+			log.Printf("ERROR: Invalid unified2 record length %d in %s at offset %d. Skipping the rest of the file", length, u.waldo.File, u.waldo.Offset)
+			info, err := u.file.Stat()
+			if err != nil {
+				log.Printf("ERROR: Unable to skip the rest of %s: %v", u.waldo.File, err)
+				break
+			}
+
+			u.waldo.Offset = info.Size()
+			break
+		}
+
+		body := make([]byte, length)
+		_, err = u.file.ReadAt(body, u.waldo.Offset+u2HeaderLen)
+		if err != nil {
+			// The rest of the record has not been written yet
+			break
+		}
+
+		u.waldo.Offset += u2HeaderLen + int64(length)
+
+		if alert, ok := decodeU2Event(rtype, body); ok {
+			alert.Sensor = localSensor
+			queueAlert(alert, u2Message(alert), hf)
+		}
+	}
+
+	return u.waldo.Offset != start
+}
+
+// Read any new records, moving on to the next file once Snort has started it. Returns true if the position changed
+func (u *U2Reader) poll(hf chan<- string) bool {
+	if u.file == nil {
+		u.start()
+		if u.file == nil {
+			return false
+		}
+	}
+
+	if info, err := u.file.Stat(); err == nil && info.Size() < u.waldo.Offset {
+		log.Printf("INFO: %s was truncated. Reading from the start", u.waldo.File)
+		u.waldo.Offset = 0
+	}
+
+	changed := u.read(hf)
+
+	// Snort only writes to the newest file, so once there is a newer one the current file is complete. This also
+	// moves on if the current file has been deleted, or skips a newer file that can not be opened
+	if len(u.newer(u.waldo.File)) > 0 {
+		u.read(hf)
+		if u.next() {
+			return true
+		}
+	}
+
+	return changed
+}
+
+// Save the position atomically
+func (u *U2Reader) saveWaldo() error {
+	data, err := json.Marshal(u.waldo)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(u.waldoPath, data, 0600)
+}
+
+// Read the unified2 files until ctx is cancelled, saving the waldo after each change
+func (u *U2Reader) run(ctx context.Context, hf chan<- string) {
+	ticker := time.NewTicker(u2Poll)
+	defer ticker.Stop()
+
+	for {
+		if u.poll(hf) {
+			err := u.saveWaldo()
+			if err != nil {
+				log.Printf("ERROR: Unable to save the unified2 waldo: %v", err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if u.file != nil {
+				u.file.Close()
+			}
+
+			return
+		}
+	}
+}
+
+// Decode an event record. ok is false for the other record types
+func decodeU2Event(rtype uint32, body []byte) (Alert, bool) {
+	addrLen := 4
+
+	switch rtype {
+	case u2EventIPv4, u2EventV2IPv4:
+	case u2EventIPv6, u2EventV2IPv6:
+		addrLen = 16
+	default:
+		return Alert{}, false
+	}
+
+	if len(body) < u2OffAddrs+2*addrLen {
+		return Alert{}, false
+	}
+
+	src := net.IP(append([]byte(nil), body[u2OffAddrs:u2OffAddrs+addrLen]...))
+	dst := net.IP(append([]byte(nil), body[u2OffAddrs+addrLen:u2OffAddrs+2*addrLen]...))
+
+	a := Alert{
+		Format:   fmtUnified2,
+		Src:      src.String(),
+		Dst:      dst.String(),
+		GID:      uint64(binary.BigEndian.Uint32(body[u2OffGID:])),
+		SID:      uint64(binary.BigEndian.Uint32(body[u2OffSID:])),
+		Severity: int(binary.BigEndian.Uint32(body[u2OffPriority:])),
+	}
+
+	a.Attacker = a.Src
+	return a, true
+}
+
+// Describe an event for the record of recent alerts, since unified2 events carry no message text
+func u2Message(a Alert) string {
+	return fmt.Sprintf("[%d:%d] [Priority: %d] %s -> %s", a.GID, a.SID, a.Severity, a.Src, a.Dst)
+}
@@ -0,0 +1,106 @@
+// yamlconfig.go reads configuration files in YAML format. Options may be grouped in nested mappings, which are
+// flattened so that each leaf key is an option name, and lists of values become comma separated options.
+// Structured sections registered with addSection() are kept as YAML nodes for the features that use them
+
+/* Copyright (c) 2018-2019 Rubicon Communications, LLC (Netgate)
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Read a YAML config file into cf
+func readYAMLConfig(cf ConfigFile, sections map[string]bool) (ConfigFile, error) {
+	var doc yaml.Node
+
+	data, err := ioutil.ReadFile(cf.path)
+	if err != nil {
+		return cf, errors.New("Unable to open configuration file. Using default values")
+	}
+
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		cf.problems = append(cf.problems, ConfigProblem{file: cf.path, line: 1, msg: fmt.Sprintf("Invalid YAML: %v", err)})
+		return cf, nil
+	}
+
+	cf.sections = make(map[string]*yaml.Node)
+
+	// An empty file has no content
+	if len(doc.Content) == 0 {
+		return cf, nil
+	}
+
+	if doc.Content[0].Kind != yaml.MappingNode {
+		cf.problems = append(cf.problems, ConfigProblem{file: cf.path, line: doc.Content[0].Line, msg: "Expected a mapping of option names to values"})
+		return cf, nil
+	}
+
+	cf.flattenYAML(doc.Content[0], sections)
+	return cf, nil
+}
+
+// Walk a mapping node, adding scalars and lists of scalars as options and descending into nested mappings
+func (cf *ConfigFile) flattenYAML(node *yaml.Node, sections map[string]bool) {
+	for idx := 0; idx+1 < len(node.Content); idx += 2 {
+		keyNode := node.Content[idx]
+		valNode := node.Content[idx+1]
+		key := strings.ToLower(keyNode.Value)
+
+		if sections[key] {
+			cf.sections[key] = valNode
+			continue
+		}
+
+		switch valNode.Kind {
+		case yaml.ScalarNode:
+			cf.values[key] = valNode.Value
+			cf.lines[key] = keyNode.Line
+
+		case yaml.MappingNode:
+			// Mappings only group options
+			cf.flattenYAML(valNode, sections)
+
+		case yaml.SequenceNode:
+			var vals []string
+
+			for _, item := range valNode.Content {
+				if item.Kind != yaml.ScalarNode {
+					cf.problems = append(cf.problems, ConfigProblem{file: cf.path, line: item.Line, msg: fmt.Sprintf("\"%s\" must be a list of values", key)})
+					vals = nil
+					break
+				}
+
+				vals = append(vals, item.Value)
+			}
+
+			if vals != nil {
+				cf.values[key] = strings.Join(vals, ",")
+				cf.lines[key] = keyNode.Line
+			}
+
+		default:
+			cf.problems = append(cf.problems, ConfigProblem{file: cf.path, line: keyNode.Line, msg: fmt.Sprintf("Unsupported value for \"%s\"", key)})
+		}
+	}
+}